@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 	"os/exec"
 	"os/signal"
@@ -11,21 +12,64 @@ import (
 	"sync"
 	"syscall"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 
 	"github.com/nokia/srlinux-ndk-go/ndk"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The BGP Speaker waits up to stopTimeout for its session to go down
+	childStopTimeout  = 10 * time.Second
+	shutdownTimeout   = 30 * time.Second
+	// The NDK manager is polled at keepAliveInterval to detect that it restarted
+	keepAliveInterval = 10 * time.Second
+	keepAliveFailures = 3
+	// Longest delay between attempts to register again
+	maxRetryTimeout   = time.Minute
 )
 
 type Vtep struct {
 	Address string `json:"address"`
+	StaticMacs []string `json:"static_macs"`
+	// IP addresses bound to a static MAC, keyed by MAC
+	MacIps map[string][]string `json:"mac_ips,omitempty"`
+	// VLAN-aware bundle services of the VTEP, keyed by ethernet tag
+	EthernetTags map[string]EthernetTag `json:"ethernet_tags,omitempty"`
+	// Learned from the bridge table of the mac-vrf, when MAC discovery is enabled
+	DiscoveredMacs []string `json:"discovered_macs,omitempty"`
+	Reachability VtepReachability `json:"reachability"`
+	Flooding VtepFlooding `json:"flooding"`
+	// Routed subnets behind the VTEP, only in an ip-vrf
+	RouterMac string `json:"router_mac,omitempty"`
+	IpPrefixes []string `json:"ip_prefixes,omitempty"`
+	// Attached to the IMET and MAC/IP routes, merged with the ones of the mac-vrf and the agent on commit
+	Communities Communities `json:"communities"`
+}
+
+// EthernetTag is a broadcast domain of a VLAN-aware bundle behind a static VTEP
+type EthernetTag struct {
+	Vni string `json:"vni"`
+	StaticMacs []string `json:"static_macs"`
 }
 
 type VniConfig struct {
     AdminState string `json:"admin_state"`
+    // mac-vrf or ip-vrf, as resolved from the network-instance
+    Type string `json:"type"`
     Vni string `json:"vni"`
     Evi string `json:"evi"`
-    Vteps []Vtep `json:"vteps"`
+    BgpInstance string `json:"bgp_instance"`
+    // Advertise static MACs with the sticky bit, so they can't move elsewhere in the fabric
+    StickyMacs bool `json:"sticky_macs"`
+    // vtep or router-id, which IP originates the routes of the VTEPs
+    Originator string `json:"originator"`
+    MacDiscovery MacDiscoveryConfig `json:"mac_discovery"`
+    Communities Communities `json:"communities"`
+    // Keyed by vtep-ip, like the static-vtep list in the YANG model
+    Vteps map[string]Vtep `json:"vteps"`
 }
 
 type BgpConfig struct {
@@ -45,7 +89,20 @@ type BgpConfig struct {
     LocalPreference struct {
         Value string `json:"value"`
     }`json:"local_preference"`
+    ExportPolicy struct {
+        DefaultAction string `json:"default_action"`
+    }`json:"export_policy"`
+    ImportPolicy struct {
+        DefaultAction string `json:"default_action"`
+    }`json:"import_policy"`
+    Metrics MetricsConfig `json:"metrics"`
+    TraceOptions TraceOptions `json:"trace_options"`
+}
 
+// ToolsCommand is an operational command forwarded to the BGP Speaker
+type ToolsCommand struct {
+    Action string `json:"action"`
+    File string `json:"file,omitempty"`
 }
 
 type Agent struct {
@@ -54,6 +111,7 @@ type Agent struct {
 
 	speaker 	 *BGPSpeaker
     configManager   *ConfigurationManager
+	metrics      *Metrics
 	gRPCConn     *grpc.ClientConn
 	logger       *zerolog.Logger
 	retryTimeout time.Duration
@@ -64,254 +122,365 @@ type Agent struct {
 	TelemetryServiceClient    ndk.SdkMgrTelemetryServiceClient
 	ChildProcess			  *exec.Cmd
 	ChildStdin				  io.WriteCloser
+
+	// Context of the telemetry calls, with the metadata of the agent
+	telemetryCtx context.Context
+	// Rib state currently published in telemetry, JSON by JS path
+	ribState map[string]string
+	duplicateMacs map[string]bool
+	// All published telemetry, JSON by JS path
+	telemetry map[string]string
+	telemetryLock sync.Mutex
+	// Closed when the BGP Speaker exited
+	childDone chan struct{}
 }
 
 func newAgent(ctx context.Context, name string, logger *zerolog.Logger) *Agent {
 	//conn, err := grpc.Dial("localhost:50053", grpc.WithInsecure())
+	// The connection is established in the background and re-established after the NDK manager restarted
 	conn, err := grpc.Dial("unix:///opt/srlinux/var/run/sr_sdk_service_manager:50053", grpc.WithInsecure())
 	if err != nil {
-		log.Fatal().
+		logger.Error().
 			Err(err).
 			Msg("gRPC connect failed")
+		return nil
 	}
 
-	// create SDK Manager Client
-	sdkMgrClient := ndk.NewSdkMgrServiceClient(conn)
-	// create Notification Service Client
-	notifSvcClient := ndk.NewSdkNotificationServiceClient(conn)
-	// create Telemetry Service Client
-	telemetrySvcClient := ndk.NewSdkMgrTelemetryServiceClient(conn)
-
-	// register agent
-	// http://learn.srlinux.dev/ndk/guide/dev/go/#register-the-agent-with-the-ndk-manager
-	r, err := sdkMgrClient.AgentRegister(ctx, &ndk.AgentRegistrationRequest{})
-	if err != nil {
-		log.Fatal().
-			Err(err).
-			Msg("Agent registration failed")
-	}
-
-	logger.Info().
-		Uint32("app-id", r.GetAppId()).
-		Str("name", name).
-		Msg("Application registered successfully!")
-
 	return &Agent{
 		logger:                    logger,
         configManager:             NewConfigurationManager(logger),
+		metrics:                   NewMetrics(logger),
 		retryTimeout:              5 * time.Second,
 		Name:                      name,
-		AppID:                     r.GetAppId(),
 		gRPCConn:                  conn,
-		SDKMgrServiceClient:       sdkMgrClient,
-		NotificationServiceClient: notifSvcClient,
-		TelemetryServiceClient:    telemetrySvcClient,
+		// create SDK Manager Client
+		SDKMgrServiceClient:       ndk.NewSdkMgrServiceClient(conn),
+		// create Notification Service Client
+		NotificationServiceClient: ndk.NewSdkNotificationServiceClient(conn),
+		// create Telemetry Service Client
+		TelemetryServiceClient:    ndk.NewSdkMgrTelemetryServiceClient(conn),
+		// The rib is published from the reader of the BGP Speaker, outside of the notification loop. NDK only
+		// accepts calls with the agent_name metadata of ctx
+		telemetryCtx:              ctx,
+		telemetry:                 make(map[string]string),
 	}
 }
 
-func (a *Agent) Run(ctx context.Context) {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM)
-	wg := &sync.WaitGroup{}
-
-	// Config notifications
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		configChan := a.StartConfigNotificationStream(ctx)
-		for {
-			select {
-			case notif := <-configChan:
-                for _,n := range notif.GetNotification() {
-                    a.configManager.processNotification(a, n.GetConfig())
-                }
-			case <-sigs:
-				a.logger.Debug().Msg("Main process received SIGTERM")
-				return
-			case <-ctx.Done():
-				return
-			}
+// register registers the agent with the NDK manager, retrying until it succeeds. The delay between attempts doubles
+// up to maxRetryTimeout, so an NDK manager that is down for long isn't flooded. It returns false when ctx is done first
+// http://learn.srlinux.dev/ndk/guide/dev/go/#register-the-agent-with-the-ndk-manager
+func (a *Agent) register(ctx context.Context) bool {
+	delay := a.retryTimeout
+	for {
+		r, err := a.SDKMgrServiceClient.AgentRegister(ctx, &ndk.AgentRegistrationRequest{})
+		if err == nil && r.GetStatus() == ndk.SdkMgrStatus_kSdkMgrSuccess {
+			a.AppID = r.GetAppId()
+			a.metrics.NdkRegistration()
+			a.logger.Info().
+				Uint32("app-id", a.AppID).
+				Str("name", a.Name).
+				Msg("Application registered successfully!")
+			return true
 		}
-	}()
-
-	wg.Wait()
-	//TODO DUMAIS: clearnup registration
-	a.TerminateChildProcess()
-}
-
+		a.logger.Warn().Err(err).
+			Str("status", r.GetStatus().String()).
+			Dur("retry-in", delay).
+			Msg("Agent registration failed")
 
-func (a *Agent) TerminateChildProcess() {
-	if a.ChildProcess != nil {
-		a.logger.Info().Msg("Kill BGP Speaker")
-		a.ChildProcess.Process.Signal(syscall.SIGTERM)
+		if !waitFor(ctx, delay) {
+			return false
+		}
+		if delay *= 2; delay > maxRetryTimeout {
+			delay = maxRetryTimeout
+		}
 	}
 }
 
-func (a *Agent) SetChildProcess(cmd *exec.Cmd) {
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr	
-
-	a.ChildProcess = cmd
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		a.logger.Info().Msg(fmt.Sprintf("Error getting stdin from BGP Speaker: %v", err))
-	}
+// waitRetry waits retryTimeout before the next attempt of an NDK call. It returns false when ctx is done first
+func (a *Agent) waitRetry(ctx context.Context) bool {
+	return waitFor(ctx, a.retryTimeout)
+}
 
-	err = cmd.Start()
-	if err != nil {
-		a.logger.Info().Msg(fmt.Sprintf("Error starting BGP Speaker: %v", err))
+// waitFor waits for a delay, it returns false when ctx is done first
+func waitFor(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	a.ChildStdin = stdin
-
 }
 
-func (a *Agent) SendToChildProcess(key string, data string) {
-	if a.ChildStdin == nil {
-		a.logger.Info().Msg("Can't write to BGP Speaker")
+// keepAlive polls the NDK manager and cancels the session when it restarted and lost the registration, the
+// subscriptions and the telemetry of the agent. That is when a keepalive is refused, or when keepAliveFailures in a
+// row time out, as a single one may only be slow
+func (a *Agent) keepAlive(ctx context.Context, cancelSession context.CancelFunc) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		// A NDK manager that hangs is as good as restarted
+		callCtx, cancel := context.WithTimeout(ctx, keepAliveInterval)
+		r, err := a.SDKMgrServiceClient.KeepAlive(callCtx, &ndk.KeepAliveRequest{})
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && r.GetStatus() == ndk.SdkMgrStatus_kSdkMgrSuccess {
+			failures = 0
+			continue
+		}
+
+		failures++
+		if status.Code(err) == codes.DeadlineExceeded && failures < keepAliveFailures {
+			a.logger.Warn().Err(err).Int("failures", failures).Msg("Keepalive timed out")
+			continue
+		}
+		a.logger.Warn().Err(err).
+			Str("status", r.GetStatus().String()).
+			Int("failures", failures).
+			Msg("Keepalive failed, NDK manager restarted")
+		cancelSession()
 		return
 	}
-	fmt.Fprintf(a.ChildStdin, "{\"key\": \""+key+"\", \"data\": "+data+"}\n")
 }
 
-func (a *Agent) StartConfigNotificationStream(ctx context.Context) chan *ndk.NotificationStreamResponse {
-	streamID := a.createNotificationSubscription(ctx)
+func (a *Agent) Run(ctx context.Context) {
+	// The shutdown sequence still talks to NDK once ctx is cancelled, with the same metadata
+	md, _ := metadata.FromOutgoingContext(ctx)
+	shutdownCtx := metadata.NewOutgoingContext(context.Background(), md)
 
-	a.logger.Info().
-		Uint64("stream-id", streamID).
-		Msg("Notification stream created")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	notificationRegisterRequest := &ndk.NotificationRegisterRequest{
-		Op:       ndk.NotificationRegisterRequest_AddSubscription,
-		StreamId: streamID,
-		SubscriptionTypes: &ndk.NotificationRegisterRequest_Config{ // config
-			Config: &ndk.ConfigSubscriptionRequest{},
-		},
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			a.logger.Info().Msg("Main process received SIGTERM")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !a.register(ctx) {
+		a.metrics.Stop(shutdownCtx)
+		a.gRPCConn.Close()
+		return
 	}
 
-	streamChan := make(chan *ndk.NotificationStreamResponse)
-	go a.startNotificationStream(ctx, notificationRegisterRequest, streamChan)
-
-	return streamChan
-}
-
-// createNotificationSubscription creates a subscription and return the Stream ID.
-// Stream ID is used to register notifications for other services.
-func (a *Agent) createNotificationSubscription(ctx context.Context) uint64 {
-	retry := time.NewTicker(a.retryTimeout)
+	// Advertise the routes of before the restart while NDK replays the configuration
+	a.configManager.warmStart(a)
 
+	// A session lasts until the NDK manager restarts. The agent then registers again, publishes its state again
+	// and NDK replays the configuration to the new subscriptions, the BGP Speaker keeps running meanwhile
 	for {
-		// get subscription and streamID
-		notificationResponse, err := a.SDKMgrServiceClient.NotificationRegister(ctx,
-			&ndk.NotificationRegisterRequest{
-				Op: ndk.NotificationRegisterRequest_Create,
-			})
-		if err != nil || notificationResponse.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
-			a.logger.Printf("agent %q could not register for notifications: %v. Status: %s", a.Name, err, notificationResponse.GetStatus().String())
-			a.logger.Printf("agent %q retrying in %s", a.Name, a.retryTimeout)
-
-			<-retry.C // retry timer
-			continue
+		a.runSession(ctx)
+		if ctx.Err() != nil || !a.register(ctx) {
+			break
 		}
-
-		return notificationResponse.GetStreamId()
+		a.replayTelemetry(ctx)
+		a.configManager.resync()
 	}
+	a.shutdown(shutdownCtx)
 }
 
-func (a *Agent) startNotificationStream(ctx context.Context, req *ndk.NotificationRegisterRequest,
-	streamChan chan *ndk.NotificationStreamResponse) {
-
-	a.logger.Info().
-		Uint64("stream-id", req.GetStreamId()).
-		Str("subscription-type", subscriptionTypeName(req)).
-		Msg("Starting streaming notifications")
-	defer close(streamChan)
-
-	retry := time.NewTicker(a.retryTimeout)
-	stream := a.getNotificationStreamClient(ctx, req)
+// runSession handles the notifications of one registration with the NDK manager, until ctx is done or keepalives fail
+func (a *Agent) runSession(ctx context.Context) {
+	agentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go a.keepAlive(ctx, cancel)
 
+	// Config notifications
+	configChan := a.StartConfigNotificationStream(ctx)
+	// The receiver closes configChan once ctx is done, wait for it so that it never outlives the session
+	defer func() {
+		cancel()
+		if configChan != nil {
+			a.drainNotifications(agentCtx, configChan)
+		}
+	}()
 	for {
 		select {
+		case notif, ok := <-configChan:
+			// Closed once ctx is done
+			if !ok {
+				return
+			}
+			a.metrics.NotificationQueueDepth(len(configChan))
+			a.dispatchNotifications(notif)
+		case vtep := <-a.configManager.monitor.Events:
+			a.dispatchNotifications(vtepEvent(vtep))
+		case vrf := <-a.configManager.discovery.Events:
+			a.dispatchNotifications(macDiscoveryEvent(vrf))
+		case <-a.configManager.resolver.Events:
+			a.dispatchNotifications(resolverEvent{})
 		case <-ctx.Done():
 			return
-		default:
-			ev, err := stream.Recv()
-			if err == io.EOF {
-				a.logger.Printf("agent %s received EOF for stream %v", a.Name, req.GetSubscriptionTypes())
-				a.logger.Printf("agent %s retrying in %s", a.Name, a.retryTimeout)
-
-				<-retry.C // retry timer
-				continue
-			}
-			if err != nil {
-				a.logger.Printf("agent %s failed to receive notification: %v", a.Name, err)
-
-				<-retry.C // retry timer
-				continue
-			}
-			streamChan <- ev
 		}
 	}
+}
 
+// drainNotifications waits for the receiver to close configChan. The notifications still queued are dispatched,
+// unless the agent is shutting down
+func (a *Agent) drainNotifications(agentCtx context.Context, configChan chan *ndk.NotificationStreamResponse) {
+	discarded := 0
+	for notif := range configChan {
+		if agentCtx.Err() != nil {
+			discarded += len(notif.GetNotification())
+			continue
+		}
+		a.dispatchNotifications(notif)
+	}
+	a.metrics.NotificationQueueDepth(0)
+	if discarded > 0 {
+		a.logger.Info().Int("notifications", discarded).Msg("Discarded queued notifications on shutdown")
+	}
 }
 
-// subscriptionTypeName returns the name of the enclosed subscription type
-func subscriptionTypeName(r *ndk.NotificationRegisterRequest) string {
-	var sType string
-	switch r.GetSubscriptionTypes().(type) {
-	case *ndk.NotificationRegisterRequest_Config:
-		sType = "config"
-	case *ndk.NotificationRegisterRequest_Appid:
-		sType = "app id"
-	case *ndk.NotificationRegisterRequest_Route:
-		sType = "route"
-	case *ndk.NotificationRegisterRequest_BfdSession:
-		sType = "bfd"
-	case *ndk.NotificationRegisterRequest_Intf:
-		sType = "interface"
-	case *ndk.NotificationRegisterRequest_LldpNeighbor:
-		sType = "lldp"
-	case *ndk.NotificationRegisterRequest_Nhg:
-		sType = "next-hop group"
-	case *ndk.NotificationRegisterRequest_NwInst:
-		sType = "network instance"
+// shutdown stops the agent in order: the BGP Speaker takes down its session so the peer withdraws the routes,
+// then the state of the agent is removed and it unregisters from NDK
+func (a *Agent) shutdown(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	a.logger.Info().Msg("Shutting down")
+
+	a.configManager.monitor.SyncProbes(map[string]VtepReachability{})
+	a.configManager.discovery.Sync(map[string]MacDiscoveryConfig{})
+	a.TerminateChildProcess()
+	a.deleteAllTelemetry(ctx)
+
+	r, err := a.SDKMgrServiceClient.AgentUnRegister(ctx, &ndk.AgentRegistrationRequest{})
+	if err != nil || r.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+		a.logger.Warn().Err(err).Str("status", r.GetStatus().String()).Msg("Agent unregistration failed")
+	} else {
+		a.logger.Info().Msg("Agent unregistered")
 	}
 
-	return sType
+	a.metrics.Stop(ctx)
+	a.gRPCConn.Close()
+}
+
+// TerminateChildProcess stops the BGP Speaker, which first sends a Cease notification to its peer,
+// and waits for it to exit. It is killed when it doesn't exit within childStopTimeout
+func (a *Agent) TerminateChildProcess() {
+	if a.ChildProcess == nil || a.ChildProcess.Process == nil {
+		return
+	}
+	a.logger.Info().Msg("Stopping BGP Speaker")
+	a.ChildProcess.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-a.childDone:
+		a.logger.Info().Msg("BGP Speaker exited")
+	case <-time.After(childStopTimeout):
+		a.logger.Warn().Dur("timeout", childStopTimeout).Msg("BGP Speaker didn't exit, killing it")
+		a.ChildProcess.Process.Kill()
+		<-a.childDone
+	}
+	a.ChildProcess = nil
+	a.ChildStdin = nil
 }
 
-// getNotificationStreamClient acquires the notification stream client that is used to receive
-// streamed notifications
-func (a *Agent) getNotificationStreamClient(
-	ctx context.Context,
-	req *ndk.NotificationRegisterRequest) ndk.SdkNotificationService_NotificationStreamClient {
+// SetChildProcess starts the BGP Speaker of the agent configured in a network-instance
+func (a *Agent) SetChildProcess(cmd *exec.Cmd, netInst string) {
+	cmd.Stderr = os.Stderr
 
-	retry := time.NewTicker(a.retryTimeout)
+	a.ChildProcess = cmd
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Error getting stdin from BGP Speaker")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Error getting stdout from BGP Speaker")
+	}
 
-	var streamClient ndk.SdkNotificationService_NotificationStreamClient
-	for {
-		registerResponse, err := a.SDKMgrServiceClient.NotificationRegister(ctx, req)
-		if err != nil || registerResponse.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
-			a.logger.Printf("agent %s failed registering to notification with req=%+v: %v", a.Name, req, err)
-			a.logger.Printf("agent %s retrying in %s", a.Name, a.retryTimeout)
+	err = cmd.Start()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Error starting BGP Speaker")
+	} else {
+		a.metrics.ChildRestart()
+		done := make(chan struct{})
+		a.childDone = done
+		go func() {
+			a.readFromChildProcess(stdout, netInst)
+			// Wait closes the pipes, so only once all output is read
+			cmd.Wait()
+			close(done)
+		}()
+	}
+	a.ChildStdin = stdin
 
-			<-retry.C // retry timer
-			continue
+}
 
-		}
+func (a *Agent) SendToChildProcess(key string, data string) {
+	if a.ChildStdin == nil {
+		a.logger.Info().Msg("Can't write to BGP Speaker")
+		a.metrics.IpcError("sent")
+		return
+	}
+	if _, err := fmt.Fprintf(a.ChildStdin, "{\"key\": \""+key+"\", \"data\": "+data+"}\n"); err != nil {
+		a.logger.Error().Err(err).Str("key", key).Msg("Error writing to BGP Speaker")
+		a.metrics.IpcError("sent")
+		return
+	}
+	a.metrics.IpcMessage("sent", key)
+}
 
-		streamClient, err = a.NotificationServiceClient.NotificationStream(ctx,
-			&ndk.NotificationStreamRequest{
-				StreamId: req.GetStreamId(),
-			})
+// readFromChildProcess handles the messages reported by the BGP Speaker on its stdout, until it exits.
+// The rib is published as state of the agent in the given network-instance
+func (a *Agent) readFromChildProcess(stdout io.Reader, netInst string) {
+	reader := newMessageReader(stdout, maxMessageSize)
+	for {
+		line, err := reader.Next()
+		if err == errMessageTooLong {
+			a.logger.Error().Int("max-size", maxMessageSize).Msg("Skipping message from BGP Speaker, too long")
+			a.metrics.IpcError("received")
+			continue
+		}
 		if err != nil {
-			a.logger.Printf("agent %s failed creating stream client with req=%+v: %v", a.Name, req, err)
-			a.logger.Printf("agent %s retrying in %s", a.Name, a.retryTimeout)
-			time.Sleep(a.retryTimeout)
+			if err != io.EOF {
+				a.logger.Error().Err(err).Msg("Error reading from BGP Speaker")
+				a.metrics.IpcError("received")
+			}
+			return
+		}
 
-			<-retry.C // retry timer
+		var msg map[string]json.RawMessage
+		var msgKey string
+		if err := json.Unmarshal(line, &msg); err != nil {
+			a.logger.Warn().Str("message", string(line)).Msg("Invalid message from BGP Speaker")
+			a.metrics.IpcError("received")
 			continue
 		}
-
-		return streamClient
+		json.Unmarshal([]byte(msg["key"]), &msgKey)
+		a.metrics.IpcMessage("received", msgKey)
+
+		if msgKey == "peer_state" {
+			var r PeerStateReport
+			json.Unmarshal([]byte(msg["data"]), &r)
+			a.metrics.PeerState(&r)
+		} else if msgKey == "routes" {
+			var r map[string]RouteReport
+			json.Unmarshal([]byte(msg["data"]), &r)
+			a.metrics.Routes(r)
+		} else if msgKey == "rib" {
+			var rib map[string][]*RibRoute
+			json.Unmarshal([]byte(msg["data"]), &rib)
+			a.publishRib(netInst, rib)
+		} else if msgKey == "duplicate_macs" {
+			var reports []duplicateMacReport
+			json.Unmarshal([]byte(msg["data"]), &reports)
+			a.publishDuplicateMacs(reports)
+		}
 	}
 }
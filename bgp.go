@@ -1,24 +1,28 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
+	"reflect"
 	"sync"
 	"syscall"
+	"time"
 
 	api "github.com/osrg/gobgp/v3/api"
-	"github.com/osrg/gobgp/v3/pkg/log"
 	"github.com/osrg/gobgp/v3/pkg/server"
 	"github.com/rs/zerolog"
-	apb "google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
+// How long Stop waits for the session to go down after the Cease notification
+const stopTimeout = 5 * time.Second
+
 type BGPSpeaker struct {
 	s         *server.BgpServer
 	LocalAS   uint32
@@ -26,15 +30,66 @@ type BGPSpeaker struct {
 	RouterId  string
 	Neighbour string
 	logger    *zerolog.Logger
+	// Reports to the agent, stdout of the child process
+	out io.Writer
+
+	LocalPreference uint32
+
+	// Applied VRF configs, updated with the VRFs that change, and ethernet segments
+	vniConfigs       map[string]VniConfig
+	ethernetSegments map[string]EthernetSegment
+	exportPolicy     *RoutingPolicy
+	importPolicy     *RoutingPolicy
+	appliedPolicy    []byte
+	maxPrefix        map[string]MaxPrefixConfig
+	prefixWarned     map[string]int
+	prefixRestart    bool
+	// Closed once a server that didn't stop within stopTimeout is done
+	stopping chan struct{}
+	// Model of the paths in the RIB by VRF and NLRI, the VRFs that change are programmed as a diff against it
+	originated map[string]map[string]*originatedPath
+	// Set when the paths of all VRFs must be built again, e.g. after the ethernet segments changed
+	rebuildAll     bool
+	routeStats     map[string]*RouteReport
+	lastRib        []byte
+	lastDuplicates []byte
+	// Parsed communities of the VTEPs, by set of communities
+	communityCache map[string]*communityAttrs
+	ipcLock        sync.Mutex
+
+	// Serializes messages from the agent with the periodic rib reports
+	lock sync.Mutex
+
+	// Client of the gobgp API of the speaker itself, for AddPathStream
+	socketDir string
+	conn      *grpc.ClientConn
+	client    api.GobgpApiClient
 }
 
 func (b *BGPSpeaker) Start() {
 	if b.s != nil {
 		b.Stop()
 	}
+	// The new server listens on the same address
+	if b.stopping != nil {
+		b.logger.Info().Msg("Waiting for the previous BGP Speaker to stop")
+		<-b.stopping
+		b.stopping = nil
+	}
 
-	b.s = server.NewBgpServer(server.LoggerOption(&appLogger{logger: b.logger}))
+	options := []server.ServerOption{server.LoggerOption(&appLogger{logger: b.logger})}
+	if dir, err := apiSocketDir(); err != nil {
+		b.logger.Warn().Err(err).Msg("Can't create gobgp API socket directory")
+	} else {
+		b.socketDir = dir
+		options = append(options, server.GrpcListenAddress("unix://"+apiSocket(dir)))
+	}
+	b.s = server.NewBgpServer(options...)
+	b.appliedPolicy = nil
+	b.originated = nil
+	b.rebuildAll = true
 	go b.s.Serve()
+	b.connectApi()
 
 	// global configuration
 	if err := b.s.StartBgp(context.Background(), &api.StartBgpRequest{
@@ -45,20 +100,39 @@ func (b *BGPSpeaker) Start() {
 			ListenAddresses: []string{b.RouterId},
 		},
 	}); err != nil {
-		b.logger.Info().Msg(fmt.Sprintf("Can't start BGP server: %v", err))
+		b.logger.Error().Err(err).Msg("Can't start BGP server")
 	}
 
 	// monitor the change of the peer state
 	if err := b.s.WatchEvent(context.Background(), &api.WatchEventRequest{Peer: &api.WatchEventRequest_Peer{}}, func(r *api.WatchEventResponse) {
-		fmt.Printf("EVENT %v\n", r.GetPeer())
+		b.logger.Debug().Str("event", r.GetPeer().String()).Msg("Peer event")
 
 		if p := r.GetPeer(); p != nil && p.Type == api.WatchEventResponse_PeerEvent_STATE {
 			b.logger.Info().Msg("State Change")
+			if p.GetPeer().GetState().GetAdminState() == api.PeerState_PFX_CT {
+				go b.prefixLimitReached()
+			}
+			state := p.GetPeer().GetState().GetSessionState()
+			b.SendToParentProcess("peer_state", &PeerStateReport{
+				Neighbor: p.GetPeer().GetState().GetNeighborAddress(),
+				State:    state.String(),
+				Value:    int32(state),
+			})
 		}
 	}); err != nil {
-		b.logger.Info().Msg(fmt.Sprintf("Can't watch event: %v", err))
+		b.logger.Error().Err(err).Msg("Can't watch event")
 	}
 
+	b.logger.Info().Str("neighbour", b.Neighbour).Msg("Adding Neighbour")
+	if err := b.s.AddPeer(context.Background(), &api.AddPeerRequest{
+		Peer: b.peer(),
+	}); err != nil {
+		b.logger.Error().Err(err).Str("neighbour", b.Neighbour).Msg("Can't add neighbour")
+	}
+}
+
+// peer is the configuration of the speaker's neighbour
+func (b *BGPSpeaker) peer() *api.Peer {
 	afisafi := api.AfiSafi{
 		Config: &api.AfiSafiConfig{
 			Family: &api.Family{
@@ -67,10 +141,11 @@ func (b *BGPSpeaker) Start() {
 			},
 			Enabled: true,
 		},
+		PrefixLimits: b.prefixLimit("evpn"),
 	}
 
 	// neighbor configuration
-	n := &api.Peer{
+	return &api.Peer{
 		Conf: &api.PeerConf{
 			NeighborAddress: b.Neighbour,
 			PeerAsn:         b.PeerAS,
@@ -86,27 +161,13 @@ func (b *BGPSpeaker) Start() {
 		},
 		AfiSafis: []*api.AfiSafi{&afisafi},
 	}
-
-	b.logger.Printf("Adding Neighbour %s", b.Neighbour)
-	if err := b.s.AddPeer(context.Background(), &api.AddPeerRequest{
-		Peer: n,
-	}); err != nil {
-		b.logger.Info().Msg(fmt.Sprintf("Can't add neighbour: %v", err))
-	}
-}
-
-func (b *BGPSpeaker) ProcessVRF(vrfConfig *VniConfig) {
-	evi, _ := strconv.ParseUint(vrfConfig.Evi, 10, 32)
-	vni, _ := strconv.ParseUint(vrfConfig.Vni, 10, 32)
-
-	for _, vtep := range vrfConfig.Vteps {
-		b.AddMulticastRoute(vtep.Address, uint32(vni), uint32(evi))
-	}
-	//TODO: For each vtep, Send RT2 messages
 }
 
 func (b *BGPSpeaker) GetRib() []*api.Path {
 	var paths []*api.Path
+	if b.s == nil {
+		return paths
+	}
 
 	b.s.ListPath(context.Background(), &api.ListPathRequest{
 		Family:    &api.Family{Afi: api.Family_AFI_L2VPN, Safi: api.Family_SAFI_EVPN},
@@ -121,111 +182,189 @@ func (b *BGPSpeaker) GetRib() []*api.Path {
 	return paths
 }
 
-func (b *BGPSpeaker) DeleteOldPaths(vrfConfig *VniConfig) {
-	evi, _ := strconv.ParseUint(vrfConfig.Evi, 10, 32)
-
-	paths := b.GetRib()
-	for _, path := range paths {
-		var nlri api.EVPNInclusiveMulticastEthernetTagRoute
-		var rd api.RouteDistinguisherIPAddress
-		path.Nlri.UnmarshalTo(&nlri)
-		nlri.Rd.UnmarshalTo(&rd)
-
-		found := false
-		for _, vtep := range vrfConfig.Vteps {
-			if vtep.Address == rd.Admin {
-				found = true
-				break
-			}
-		}
-
-		if !found || rd.Assigned != uint32(evi) {
-			b.DeleteMulticastRoute(path, vrfConfig.Evi)
-		}
-	}
-}
-
-func (b *BGPSpeaker) DeleteMulticastRoute(path *api.Path, evi string) {
-	b.logger.Info().Msgf("Deleting Path:  %v", path)
+func (b *BGPSpeaker) DeletePath(path *api.Path) bool {
+	b.logger.Info().Str("path", path.String()).Msg("Deleting Path")
 	err := b.s.DeletePath(context.Background(), &api.DeletePathRequest{
 		TableType: api.TableType_GLOBAL,
 		Path:      path,
 	})
 	if err != nil {
-		b.logger.Info().Msg(fmt.Sprintf("Can't delete path: %v", err))
+		b.logger.Error().Err(err).Msg("Can't delete path")
+		return false
 	}
+	return true
 }
 
-func (b *BGPSpeaker) ProcessRoutes(vniConfigs map[string]VniConfig) {
-	b.logger.Info().Msgf("BGP Speaker Processing VRF Config: %v", vniConfigs)
+// ProcessRoutes applies the configs of the VRFs that changed, a nil config deletes its VRF. Only the paths of these
+// VRFs are built again and diffed against the RIB, unless all must be
+func (b *BGPSpeaker) ProcessRoutes(delta map[string]*VniConfig) {
+	b.logger.Info().Interface("configs", delta).Msg("BGP Speaker Processing VRF Config")
 
-	for _, vrfConfig := range vniConfigs {
-		// This will delete any vtep and vrf that dont match. So a modification would trigger a delete and then a create
-		b.DeleteOldPaths(&vrfConfig)
-		b.ProcessVRF(&vrfConfig)
+	if b.vniConfigs == nil {
+		b.vniConfigs = make(map[string]VniConfig)
+	}
+	vrfs := make(map[string]bool)
+	for vrf, config := range delta {
+		if config == nil {
+			delete(b.vniConfigs, vrf)
+		} else {
+			b.vniConfigs[vrf] = *config
+		}
+		vrfs[vrf] = true
 	}
-}
 
-func (b *BGPSpeaker) AddMulticastRoute(vtep string, vni uint32, evi uint32) {
-	rd, _ := apb.New(&api.RouteDistinguisherIPAddress{
-		Admin:    vtep,
-		Assigned: evi,
-	})
+	b.routeStats = make(map[string]*RouteReport)
+	if b.s == nil {
+		b.logger.Warn().Msg("BGP Speaker not running, not advertising routes")
+		return
+	}
 
-	nlri, _ := apb.New(&api.EVPNInclusiveMulticastEthernetTagRoute{
-		Rd:          rd,
-		IpAddress:   b.RouterId,
-		EthernetTag: uint32(0),
-	})
+	// Policies match mac-vrfs on their EVI, and must be in place before routes get their markers
+	b.syncPolicies()
 
-	ext1, _ := apb.New(&api.TwoOctetAsSpecificExtended{
-		IsTransitive: true,
-		SubType:      2, // EC_SUBTYPE_ROUTE_TARGET
-		Asn:          uint32(b.LocalAS),
-		LocalAdmin:   uint32(evi),
-	})
+	if b.rebuildAll {
+		b.rebuildAll = false
+		for vrf := range b.vniConfigs {
+			vrfs[vrf] = true
+		}
+		for vrf := range b.originated {
+			vrfs[vrf] = true
+		}
+	}
+	b.pruneCommunities(b.vniConfigs)
+	desired := b.originatedPaths(vrfs)
 
-	ext2, _ := apb.New(&api.EncapExtended{
-		TunnelType: 8, // TUNNEL_TYPE_VXLAN
-	})
+	// Only program what changed, withdrawing e.g. the routes of a deleted vtep or vrf
+	added, withdrawn := b.pathDiff(desired)
+	b.ProgramPaths(added, withdrawn)
 
-	a1, _ := apb.New(&api.OriginAttribute{
-		Origin: 0,
-	})
+	// The rib follows with the next periodic report
+	b.SendToParentProcess("routes", b.routeStats)
+}
 
-	a2, _ := apb.New(&api.NextHopAttribute{
-		NextHop: vtep,
-	})
+func (b *BGPSpeaker) countRoute(vrf string, advertised bool) {
+	r, found := b.routeStats[vrf]
+	if !found {
+		r = &RouteReport{}
+		b.routeStats[vrf] = r
+	}
+	if advertised {
+		r.Advertised++
+	} else {
+		r.Withdrawn++
+	}
+}
 
-	a3, _ := apb.New(&api.PmsiTunnelAttribute{
-		Flags: 0,
-		Type:  6, // PMSI_TUNNEL_TYPE_INGRESS_REPL,
-		Label: vni,
-		Id:    net.ParseIP(vtep).To4(),
-	})
+// SendToParentProcess reports to the agent over stdout, using the same framing as SendToChildProcess
+func (b *BGPSpeaker) SendToParentProcess(key string, data interface{}) {
+	str, err := json.Marshal(data)
+	if err != nil {
+		b.logger.Error().Err(err).Str("key", key).Msg("Can't encode message for agent")
+		return
+	}
 
-	a4, _ := apb.New(&api.ExtendedCommunitiesAttribute{
-		Communities: []*apb.Any{ext1, ext2},
-	})
+	b.ipcLock.Lock()
+	defer b.ipcLock.Unlock()
+	fmt.Fprintf(b.out, "{\"key\": \""+key+"\", \"data\": %s}\n", str)
+}
 
+func (b *BGPSpeaker) AddPath(path *api.Path) bool {
 	_, err := b.s.AddPath(context.Background(), &api.AddPathRequest{
-		Path: &api.Path{
-			Family: &api.Family{Afi: api.Family_AFI_L2VPN, Safi: api.Family_SAFI_EVPN},
-			Nlri:   nlri,
-			Pattrs: []*apb.Any{a1, a2, a3, a4},
-		},
+		Path: path,
 	})
 
 	if err != nil {
-		b.logger.Info().Msg(fmt.Sprintf("Can't add path: %v", err))
+		b.logger.Error().Err(err).Str("path", path.String()).Msg("Can't add path")
+		return false
 	}
+	return true
 }
 
+// ProcessTool executes an operational command received from the tools tree
+func (b *BGPSpeaker) ProcessTool(cmd *ToolsCommand) {
+	if b.s == nil {
+		b.logger.Warn().Str("action", cmd.Action).Msg("BGP Speaker not running, ignoring tools command")
+		return
+	}
+
+	var err error
+	switch cmd.Action {
+	case "reset-peer":
+		// Also brings back a session torn down by the prefix limit
+		if err = b.s.EnablePeer(context.Background(), &api.EnablePeerRequest{Address: b.Neighbour}); err != nil {
+			break
+		}
+		err = b.s.ResetPeer(context.Background(), &api.ResetPeerRequest{
+			Address:       b.Neighbour,
+			Communication: "reset by operator",
+		})
+	case "soft-clear":
+		err = b.s.ResetPeer(context.Background(), &api.ResetPeerRequest{
+			Address:   b.Neighbour,
+			Soft:      true,
+			Direction: api.ResetPeerRequest_OUT,
+		})
+	case "resync":
+		// The agent sends the configs of all VRFs again, the ones it doesn't get withdrawn
+		b.ReconcilePaths()
+		b.vniConfigs = nil
+	case "dump-rib":
+		err = b.DumpRib(cmd.File)
+	default:
+		b.logger.Warn().Str("action", cmd.Action).Msg("Unknown tools command")
+		return
+	}
+
+	if err != nil {
+		b.logger.Error().Err(err).Str("action", cmd.Action).Msg("Tools command failed")
+		return
+	}
+	b.logger.Info().Str("action", cmd.Action).Msg("Tools command done")
+}
+
+// DumpRib writes all EVPN paths, one JSON object per line
+func (b *BGPSpeaker) DumpRib(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, path := range b.GetRib() {
+		str, err := protojson.Marshal(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(f, "%s\n", str)
+	}
+	return nil
+}
+
+// Stop stops gobgp, which first sends a Cease notification to the peer so that it withdraws the routes of the
+// speaker right away. gobgp waits for the session to go down, which is given up on after stopTimeout. The next Start
+// still waits for it
 func (b *BGPSpeaker) Stop() {
 	if b.s == nil {
 		return
 	}
-	b.s.Stop()
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn, b.client = nil, nil
+	}
+
+	done := make(chan struct{})
+	go func(s *server.BgpServer) {
+		s.Stop()
+		close(done)
+	}(b.s)
+	select {
+	case <-done:
+		b.logger.Info().Msg("BGP Speaker stopped")
+	case <-time.After(stopTimeout):
+		b.logger.Warn().Dur("timeout", stopTimeout).Msg("Timeout waiting for the session to go down, BGP Speaker stopped anyway")
+		b.stopping = done
+	}
+	b.removeApiSocket()
 	b.s = nil
 }
 
@@ -233,110 +372,153 @@ func NewBGPSpeaker(logger *zerolog.Logger) *BGPSpeaker {
 	var speaker BGPSpeaker
 
 	speaker.logger = logger
+	speaker.out = os.Stdout
+	speaker.prefixWarned = make(map[string]int)
 
 	return &speaker
 }
 
 func (b *BGPSpeaker) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			b.logger.Info().Str("signal", sig.String()).Msg("BGP Speaker received signal")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
 	ifaces, _ := net.Interfaces()
-	b.logger.Debug().Msg(fmt.Sprintf("Interfaces: %v\n", ifaces))
-
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	b.logger.Debug().Interface("interfaces", ifaces).Msg("Interfaces")
 
+	// Messages from the agent, until it closes stdin
 	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
+		defer cancel()
+		b.readMessages(os.Stdin)
+		b.logger.Info().Msg("Agent closed stdin")
+	}()
 
+	// Received routes change without any message from the agent, so report the rib periodically
+	go func() {
+		ticker := time.NewTicker(ribInterval)
+		defer ticker.Stop()
 		for {
-			for scanner.Scan() {
-				text := scanner.Text()
-
-				var msg map[string]json.RawMessage
-				var msgKey string
-				json.Unmarshal([]byte(text), &msg)
-				b.logger.Debug().Msgf("BGP Process Received message: key=%s, data=%s\n", msg["key"], msg["data"])
-				json.Unmarshal([]byte(msg["key"]), &msgKey)
-
-				if msgKey == "bgpc" {
-					var bgpc BgpConfig
-					json.Unmarshal([]byte(msg["data"]), &bgpc)
-					b.logger.Info().Msg("BGP Speaker Processing BGP Config")
-
-					b.Stop()
-
-					if bgpc.AdminState == "ADMIN_STATE_enable" {
-						b.logger.Info().Msg("Starting BGP Speaker")
-						b.LocalAS = getUint32FromJson(bgpc.LocalAS.Value)
-						b.PeerAS = getUint32FromJson(bgpc.PeerAS.Value)
-						b.RouterId = bgpc.SourceAddress.Value
-						b.Neighbour = bgpc.PeerAddress.Value
-						b.Start()
-					} else {
-						b.logger.Info().Msg("Stopping BGP Speaker")
-					}
-				} else if msgKey == "vrf" {
-					var configs map[string]VniConfig
-					json.Unmarshal([]byte(msg["data"]), &configs)
-					b.ProcessRoutes(configs)
-				}
-
-			}
-
-			if err := scanner.Err(); err != nil {
-				b.logger.Info().Msg(fmt.Sprintf("%v", err))
-				break
+			select {
+			case <-ticker.C:
+				b.lock.Lock()
+				b.SendRib()
+				b.CheckMaxPrefix()
+				b.lock.Unlock()
+			case <-ctx.Done():
+				return
 			}
 		}
-		wg.Done()
-	}()
-
-	go func() {
-		<-sigs
-		wg.Done()
 	}()
 
-	wg.Wait()
-	b.logger.Debug().Msg("BGP Speaker Exiting")
-
+	<-ctx.Done()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.Stop()
+	b.logger.Info().Msg("BGP Speaker Exiting")
 }
 
-// implement github.com/osrg/gobgp/v3/pkg/log/Logger interface
-type appLogger struct {
-	logger *zerolog.Logger
-}
-
-func (l *appLogger) Panic(msg string, fields log.Fields) {
-	l.logger.Panic().Msg(msg)
-}
-
-func (l *appLogger) Fatal(msg string, fields log.Fields) {
-	l.logger.Fatal().Msg(msg)
-}
-
-func (l *appLogger) Error(msg string, fields log.Fields) {
-	l.logger.Error().Msg(msg)
+// readMessages handles the messages of the agent until it closes the pipe
+func (b *BGPSpeaker) readMessages(r io.Reader) {
+	reader := newMessageReader(r, maxMessageSize)
+	for {
+		line, err := reader.Next()
+		if err == errMessageTooLong {
+			b.logger.Error().Int("max-size", maxMessageSize).Msg("Skipping message from agent, too long")
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				b.logger.Error().Err(err).Msg("Error reading from agent")
+			}
+			return
+		}
+		b.processMessage(line)
+	}
 }
 
-func (l *appLogger) Warn(msg string, fields log.Fields) {
-	l.logger.Warn().Msg(msg)
-}
+func (b *BGPSpeaker) processMessage(line []byte) {
+	var msg map[string]json.RawMessage
+	var msgKey string
+	if err := json.Unmarshal(line, &msg); err != nil {
+		b.logger.Warn().Str("message", string(line)).Msg("Invalid message from agent")
+		return
+	}
+	b.logger.Debug().RawJSON("key", msg["key"]).RawJSON("data", msg["data"]).Msg("BGP Process Received message")
+	json.Unmarshal([]byte(msg["key"]), &msgKey)
 
-func (l *appLogger) Info(msg string, fields log.Fields) {
-	l.logger.Info().Msg(msg)
-}
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
-func (l *appLogger) Debug(msg string, fields log.Fields) {
-	l.logger.Debug().Msgf("%v %s", fields, msg)
-}
+	if msgKey == "bgpc" {
+		var bgpc BgpConfig
+		json.Unmarshal([]byte(msg["data"]), &bgpc)
+		b.logger.Info().Msg("BGP Speaker Processing BGP Config")
 
-func (l *appLogger) SetLevel(level log.LogLevel) {
-}
+		b.Stop()
 
-func (l *appLogger) GetLevel() log.LogLevel {
-	return log.LogLevel(l.logger.GetLevel())
+		if bgpc.AdminState == "ADMIN_STATE_enable" {
+			b.logger.Info().Msg("Starting BGP Speaker")
+			b.LocalAS = getUint32FromJson(bgpc.LocalAS.Value)
+			b.PeerAS = getUint32FromJson(bgpc.PeerAS.Value)
+			b.RouterId = bgpc.SourceAddress.Value
+			b.Neighbour = bgpc.PeerAddress.Value
+			b.LocalPreference = getUint32FromJson(bgpc.LocalPreference.Value)
+			b.Start()
+		} else {
+			b.logger.Info().Msg("Stopping BGP Speaker")
+		}
+	} else if msgKey == "tools" {
+		var cmd ToolsCommand
+		json.Unmarshal([]byte(msg["data"]), &cmd)
+		b.ProcessTool(&cmd)
+	} else if msgKey == "trace_options" {
+		var t TraceOptions
+		json.Unmarshal([]byte(msg["data"]), &t)
+		applyTraceOptions(b.logger, &t)
+	} else if msgKey == "es" {
+		// Applied with the "vrf" message that follows. The ESI of the MAC/IP routes changes with them
+		var segments map[string]EthernetSegment
+		json.Unmarshal([]byte(msg["data"]), &segments)
+		if !reflect.DeepEqual(segments, b.ethernetSegments) {
+			b.ethernetSegments = segments
+			b.rebuildAll = true
+		}
+	} else if msgKey == "export_policy" {
+		// Policies are applied with the "vrf" message that follows. The MAC/IP routes get the markers of the export policy
+		var policy RoutingPolicy
+		json.Unmarshal([]byte(msg["data"]), &policy)
+		if b.exportPolicy == nil || !reflect.DeepEqual(policy, *b.exportPolicy) {
+			b.exportPolicy = &policy
+			b.rebuildAll = true
+		}
+	} else if msgKey == "import_policy" {
+		var policy RoutingPolicy
+		json.Unmarshal([]byte(msg["data"]), &policy)
+		b.importPolicy = &policy
+	} else if msgKey == "max_prefix" {
+		var limits map[string]MaxPrefixConfig
+		json.Unmarshal([]byte(msg["data"]), &limits)
+		if !reflect.DeepEqual(limits, b.maxPrefix) {
+			b.maxPrefix = limits
+			b.SyncMaxPrefix()
+		}
+	} else if msgKey == "vrf" {
+		// Only the VRFs that changed, null for the deleted ones
+		var delta map[string]*VniConfig
+		json.Unmarshal([]byte(msg["data"]), &delta)
+		b.ProcessRoutes(delta)
+	}
 }
 
 /*func (b *BGPSpeaker)CreateVRF(vtep string, vrfConfig *VniConfig) {
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/proto"
+)
+
+// testVniConfigs returns mac-vrfs with static VTEPs and MACs, generation shifts the last byte of the MACs
+func testVniConfigs(vrfs int, vteps int, macs int, generation int) map[string]VniConfig {
+	configs := make(map[string]VniConfig)
+	for v := 0; v < vrfs; v++ {
+		config := VniConfig{
+			AdminState: "ADMIN_STATE_enable",
+			Evi:        fmt.Sprint(v + 1),
+			Vni:        fmt.Sprint(v + 1),
+			Vteps:      make(map[string]Vtep),
+		}
+		for t := 0; t < vteps; t++ {
+			vtep := Vtep{Address: fmt.Sprintf("10.0.%d.%d", t/250, 1+t%250)}
+			for m := 0; m < macs; m++ {
+				vtep.StaticMacs = append(vtep.StaticMacs, fmt.Sprintf("00:%02x:%02x:%02x:%02x:%02x", v>>8&0xff, v&0xff, t&0xff, m&0xff, (generation+m)&0xff))
+			}
+			config.Vteps[vtep.Address] = vtep
+		}
+		configs[fmt.Sprintf("mac-vrf-%d", v)] = config
+	}
+	return configs
+}
+
+func TestParseStandardCommunity(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint32
+		err   bool
+	}{
+		{value: "65000:100", want: 65000<<16 | 100},
+		{value: "0:0", want: 0},
+		{value: "65535:65535", want: 0xffffffff},
+		{value: "no-export", want: 0xffffff01},
+		{value: "65536:1", err: true},
+		{value: "1:65536", err: true},
+		{value: "65000", err: true},
+		{value: "1:2:3", err: true},
+		{value: "target:1:2", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseStandardCommunity(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parseStandardCommunity(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseStandardCommunity(%q) = %#x, want %#x", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseExtendedCommunity(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{value: "target:65000:100", want: "65000:100"},
+		{value: "origin:1.1.1.1:100", want: "1.1.1.1:100"},
+		{value: "65000:100", err: true},
+		{value: "target:foo", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseExtendedCommunity(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parseExtendedCommunity(%q) error = %v, want error %v", tt.value, err, tt.err)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parseExtendedCommunity(%q) = %s, want %s", tt.value, got.String(), tt.want)
+		}
+	}
+}
+
+func TestCommunityAttrs(t *testing.T) {
+	b := newTestSpeaker()
+	c := Communities{
+		Standard: []string{"65000:100", "65536:1"},
+		Extended: []string{"target:65000:100", "bogus"},
+		Large:    []string{"65000:1:100", "1:2"},
+	}
+	attrs := b.communityAttrs(&c)
+	if !reflect.DeepEqual(attrs.standard, []uint32{65000<<16 | 100}) {
+		t.Errorf("standard = %v", attrs.standard)
+	}
+	if len(attrs.extended) != 1 {
+		t.Errorf("extended = %v", attrs.extended)
+	}
+	if len(attrs.large) != 1 || attrs.large[0].GlobalAdmin != 65000 || attrs.large[0].LocalData2 != 100 {
+		t.Errorf("large = %v", attrs.large)
+	}
+
+	// Parsed once per set of communities, until no VTEP uses it
+	same := Communities{Standard: []string{"65000:100", "65536:1"}, Extended: c.Extended, Large: c.Large}
+	if b.communityAttrs(&same) != attrs {
+		t.Error("communities parsed again")
+	}
+	b.pruneCommunities(map[string]VniConfig{})
+	if len(b.communityCache) != 0 {
+		t.Errorf("cache not pruned: %v", b.communityCache)
+	}
+}
+
+func TestMergeCommunities(t *testing.T) {
+	merged := mergeCommunities(
+		Communities{Standard: []string{"65000:1"}},
+		Communities{Standard: []string{"65000:2", "65000:1"}, Large: []string{"65000:1:1"}},
+		Communities{Extended: []string{"target:65000:1"}, Large: []string{"65000:1:1"}},
+	)
+	want := Communities{
+		Standard: []string{"65000:1", "65000:2"},
+		Extended: []string{"target:65000:1"},
+		Large:    []string{"65000:1:1"},
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("mergeCommunities() = %+v, want %+v", merged, want)
+	}
+}
+
+func TestOriginatedPaths(t *testing.T) {
+	tests := []struct {
+		name   string
+		config VniConfig
+		// Paths advertised by route type
+		want map[string]int
+	}{
+		{
+			name:   "static MACs",
+			config: VniConfig{Evi: "1", Vni: "10", Vteps: map[string]Vtep{"1.1.1.1": {StaticMacs: []string{"00:00:00:00:00:01", "00:00:00:00:00:02"}}}},
+			want:   map[string]int{"multicast": 1, "mac-ip": 2},
+		},
+		{
+			name:   "suppressed IMET",
+			config: VniConfig{Evi: "1", Vni: "10", Vteps: map[string]Vtep{"1.1.1.1": {StaticMacs: []string{"00:00:00:00:00:01"}, Flooding: VtepFlooding{SuppressImet: true}}}},
+			want:   map[string]int{"mac-ip": 1},
+		},
+		{
+			name:   "MAC with IPs",
+			config: VniConfig{Evi: "1", Vni: "10", Vteps: map[string]Vtep{"1.1.1.1": {MacIps: map[string][]string{"00:00:00:00:00:01": {"10.0.0.1", "10.0.0.2"}}}}},
+			want:   map[string]int{"multicast": 1, "mac-ip": 3},
+		},
+		{
+			name: "ethernet tags",
+			config: VniConfig{Evi: "1", Vni: "10", Vteps: map[string]Vtep{"1.1.1.1": {EthernetTags: map[string]EthernetTag{
+				"100": {Vni: "100", StaticMacs: []string{"00:00:00:00:00:01"}},
+				"200": {Vni: "200"},
+			}}}},
+			want: map[string]int{"multicast": 3, "mac-ip": 1},
+		},
+		{
+			name:   "ip-vrf",
+			config: VniConfig{Type: "ip-vrf", Evi: "1", Vni: "10", Vteps: map[string]Vtep{"1.1.1.1": {RouterMac: "00:00:00:00:00:01", IpPrefixes: []string{"10.0.0.0/24", "10.0.1.0/24"}}}},
+			want:   map[string]int{"prefix": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestSpeaker()
+			paths := allPaths(b, map[string]VniConfig{"vrf": tt.config})
+			got := make(map[string]int)
+			for _, p := range paths["vrf"] {
+				got[routeTypeOf(t, p.path)]++
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("originatedPaths() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func routeTypeOf(t *testing.T, path *api.Path) string {
+	m, err := path.Nlri.UnmarshalNew()
+	if err != nil {
+		t.Fatalf("invalid NLRI: %v", err)
+	}
+	switch m.(type) {
+	case *api.EVPNInclusiveMulticastEthernetTagRoute:
+		return "multicast"
+	case *api.EVPNMACIPAdvertisementRoute:
+		return "mac-ip"
+	case *api.EVPNIPPrefixRoute:
+		return "prefix"
+	}
+	return fmt.Sprintf("%T", m)
+}
+
+func TestPolicyApi(t *testing.T) {
+	b := newTestSpeaker()
+	b.vniConfigs = map[string]VniConfig{"mac-vrf-1": {Evi: "1"}}
+
+	tests := []struct {
+		name      string
+		direction string
+		policy    RoutingPolicy
+		// Names of the statements of the gobgp policy and of the defined sets
+		statements []string
+		sets       []string
+		actions    []api.RouteAction
+	}{
+		{
+			name:       "default only",
+			direction:  "export",
+			policy:     RoutingPolicy{DefaultAction: "DEFAULT_ACTION_reject"},
+			statements: []string{"export-default"},
+			actions:    []api.RouteAction{api.RouteAction_REJECT},
+		},
+		{
+			name:      "ordered by sequence-id",
+			direction: "export",
+			policy: RoutingPolicy{Statements: []*PolicyStatement{
+				{SequenceId: 20, Vtep: "1.1.1.1", Result: "POLICY_RESULT_reject"},
+				{SequenceId: 10, MacVrf: "mac-vrf-1", Result: "POLICY_RESULT_next_statement"},
+			}},
+			statements: []string{"export-10", "export-20", "export-default"},
+			sets:       []string{"export-10-mac-vrf"},
+			actions:    []api.RouteAction{api.RouteAction_NONE, api.RouteAction_REJECT, api.RouteAction_ACCEPT},
+		},
+		{
+			name:      "mac-vrf not advertised",
+			direction: "import",
+			policy: RoutingPolicy{Statements: []*PolicyStatement{
+				{SequenceId: 10, MacVrf: "mac-vrf-2", Result: "POLICY_RESULT_reject"},
+			}},
+			statements: []string{"import-default"},
+			actions:    []api.RouteAction{api.RouteAction_ACCEPT},
+		},
+		{
+			name:      "MAC marker",
+			direction: "export",
+			policy: RoutingPolicy{Statements: []*PolicyStatement{
+				{SequenceId: 10, MacAddress: "00:00:00:00:00:01", Result: "POLICY_RESULT_reject"},
+			}},
+			statements: []string{"export-10", "export-default"},
+			sets:       []string{"export-10-mac"},
+			actions:    []api.RouteAction{api.RouteAction_REJECT, api.RouteAction_ACCEPT},
+		},
+		{
+			name:      "no MAC marker on import",
+			direction: "import",
+			policy: RoutingPolicy{Statements: []*PolicyStatement{
+				{SequenceId: 10, MacAddress: "00:00:00:00:00:01", Result: "POLICY_RESULT_reject"},
+			}},
+			statements: []string{"import-10", "import-default"},
+			actions:    []api.RouteAction{api.RouteAction_REJECT, api.RouteAction_ACCEPT},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sets, policy := b.policyApi(tt.direction, &tt.policy)
+			var statements, setNames []string
+			var actions []api.RouteAction
+			for _, s := range policy.Statements {
+				statements = append(statements, s.Name)
+				actions = append(actions, s.Actions.RouteAction)
+			}
+			for _, s := range sets {
+				setNames = append(setNames, s.Name)
+			}
+			if !reflect.DeepEqual(statements, tt.statements) {
+				t.Errorf("statements = %v, want %v", statements, tt.statements)
+			}
+			if !reflect.DeepEqual(setNames, tt.sets) {
+				t.Errorf("sets = %v, want %v", setNames, tt.sets)
+			}
+			if !reflect.DeepEqual(actions, tt.actions) {
+				t.Errorf("actions = %v, want %v", actions, tt.actions)
+			}
+		})
+	}
+}
+
+func TestMacMarkers(t *testing.T) {
+	b := newTestSpeaker()
+	b.exportPolicy = &RoutingPolicy{Statements: []*PolicyStatement{
+		{SequenceId: 10, MacAddress: "00:00:00:00:00:0A"},
+		{SequenceId: 20, Vtep: "1.1.1.1"},
+	}}
+	want := []*api.LargeCommunity{{GlobalAdmin: 65000, LocalData1: policyMarker, LocalData2: 10}}
+	got := b.macMarkers("00:00:00:00:00:0a")
+	if len(got) != len(want) || !proto.Equal(got[0], want[0]) {
+		t.Errorf("macMarkers() = %v, want %v", got, want)
+	}
+	if got := b.macMarkers("00:00:00:00:00:0b"); len(got) != 0 {
+		t.Errorf("macMarkers() of another MAC = %v", got)
+	}
+}
+
+func BenchmarkProcessRoutes(b *testing.B) {
+	speaker := newTestSpeaker()
+	speaker.Start()
+	defer speaker.Stop()
+
+	var generations []map[string]*VniConfig
+	for g := 0; g < 2; g++ {
+		delta := make(map[string]*VniConfig)
+		for vrf, config := range testVniConfigs(50, 4, 4, g) {
+			config := config
+			delta[vrf] = &config
+		}
+		generations = append(generations, delta)
+	}
+	speaker.ProcessRoutes(generations[0])
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Every VTEP replaces its MACs
+		speaker.ProcessRoutes(generations[(i+1)%2])
+	}
+}
+
+func BenchmarkOriginatedPaths(b *testing.B) {
+	speaker := newTestSpeaker()
+	speaker.vniConfigs = testVniConfigs(100, 10, 4, 0)
+	vrfs := make(map[string]bool)
+	for vrf := range speaker.vniConfigs {
+		vrfs[vrf] = true
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		speaker.originatedPaths(vrfs)
+	}
+}
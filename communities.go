@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	"github.com/osrg/gobgp/v3/pkg/packet/bgp"
+	apb "google.golang.org/protobuf/types/known/anypb"
+)
+
+// Communities are attached to the IMET and MAC/IP routes of a VTEP. They can be configured for the agent,
+// a mac-vrf and a VTEP, the routes of a VTEP carry all of them
+type Communities struct {
+	// e.g. 65000:100 or no-export
+	Standard []string `json:"standard,omitempty"`
+	// e.g. target:65000:100 or origin:1.1.1.1:100
+	Extended []string `json:"extended,omitempty"`
+	// e.g. 65000:1:100
+	Large []string `json:"large,omitempty"`
+}
+
+// mergeCommunities returns the communities of all levels, without duplicates
+func mergeCommunities(levels ...Communities) Communities {
+	var merged Communities
+	seen := make(map[string]bool)
+	add := func(values []string, to *[]string, kind string) {
+		for _, v := range values {
+			if !seen[kind+v] {
+				seen[kind+v] = true
+				*to = append(*to, v)
+			}
+		}
+	}
+	for _, c := range levels {
+		add(c.Standard, &merged.Standard, "standard")
+		add(c.Extended, &merged.Extended, "extended")
+		add(c.Large, &merged.Large, "large")
+	}
+	return merged
+}
+
+func parseStandardCommunity(value string) (uint32, error) {
+	if c, found := bgp.WellKnownCommunityValueMap[value]; found {
+		return uint32(c), nil
+	}
+	elems := strings.Split(value, ":")
+	if len(elems) != 2 {
+		return 0, fmt.Errorf("invalid community %s", value)
+	}
+	asn, err := strconv.ParseUint(elems[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %s", value)
+	}
+	local, err := strconv.ParseUint(elems[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %s", value)
+	}
+	return uint32(asn<<16 | local), nil
+}
+
+func parseExtendedCommunity(value string) (bgp.ExtendedCommunityInterface, error) {
+	if rt := strings.TrimPrefix(value, "target:"); rt != value {
+		return bgp.ParseExtendedCommunity(bgp.EC_SUBTYPE_ROUTE_TARGET, rt)
+	}
+	if origin := strings.TrimPrefix(value, "origin:"); origin != value {
+		return bgp.ParseExtendedCommunity(bgp.EC_SUBTYPE_ROUTE_ORIGIN, origin)
+	}
+	return nil, fmt.Errorf("invalid extended community %s, expected target: or origin:", value)
+}
+
+// communityAttrs are the parsed communities of a VTEP, in the encoding of the gobgp API
+type communityAttrs struct {
+	standard []uint32
+	extended []*apb.Any
+	large    []*api.LargeCommunity
+}
+
+// key identifies a set of communities in the cache of the speaker
+func (c *Communities) key() string {
+	return strings.Join(c.Standard, ",") + "|" + strings.Join(c.Extended, ",") + "|" + strings.Join(c.Large, ",")
+}
+
+// communityAttrs returns the parsed communities of a VTEP. Each set is parsed once, when it first shows up in the configs
+func (b *BGPSpeaker) communityAttrs(c *Communities) *communityAttrs {
+	key := c.key()
+	if attrs, found := b.communityCache[key]; found {
+		return attrs
+	}
+	if b.communityCache == nil {
+		b.communityCache = make(map[string]*communityAttrs)
+	}
+	attrs := b.parseCommunities(c)
+	b.communityCache[key] = attrs
+	return attrs
+}
+
+// pruneCommunities drops the parsed communities that no VTEP uses anymore
+func (b *BGPSpeaker) pruneCommunities(vniConfigs map[string]VniConfig) {
+	used := make(map[string]bool)
+	for _, vrfConfig := range vniConfigs {
+		for _, vtep := range vrfConfig.Vteps {
+			used[vtep.Communities.key()] = true
+		}
+	}
+	for key := range b.communityCache {
+		if !used[key] {
+			delete(b.communityCache, key)
+		}
+	}
+}
+
+// parseCommunities converts communities to the gobgp API. Invalid ones are logged and left out
+func (b *BGPSpeaker) parseCommunities(c *Communities) *communityAttrs {
+	attrs := &communityAttrs{}
+	for _, value := range c.Standard {
+		community, err := parseStandardCommunity(value)
+		if err != nil {
+			b.logger.Warn().Err(err).Msg("Skipping community")
+			continue
+		}
+		attrs.standard = append(attrs.standard, community)
+	}
+
+	var extended []bgp.ExtendedCommunityInterface
+	for _, value := range c.Extended {
+		community, err := parseExtendedCommunity(value)
+		if err != nil {
+			b.logger.Warn().Err(err).Msg("Skipping extended community")
+			continue
+		}
+		extended = append(extended, community)
+	}
+	if len(extended) > 0 {
+		a, err := apiutil.NewExtendedCommunitiesAttributeFromNative(bgp.NewPathAttributeExtendedCommunities(extended))
+		if err != nil {
+			b.logger.Warn().Err(err).Msg("Skipping extended communities")
+		} else {
+			attrs.extended = a.Communities
+		}
+	}
+
+	for _, value := range c.Large {
+		community, err := bgp.ParseLargeCommunity(value)
+		if err != nil {
+			b.logger.Warn().Err(err).Str("community", value).Msg("Skipping large community")
+			continue
+		}
+		attrs.large = append(attrs.large, &api.LargeCommunity{
+			GlobalAdmin: community.ASN,
+			LocalData1:  community.LocalData1,
+			LocalData2:  community.LocalData2,
+		})
+	}
+	return attrs
+}
+
+// withCommunities adds the standard and large communities of a VTEP to its route. The policy markers of
+// a MAC are carried in the same large communities attribute, a path has at most one of each attribute
+func (b *BGPSpeaker) withCommunities(path *api.Path, c *communityAttrs, mac string) *api.Path {
+	if len(c.standard) > 0 {
+		attr, _ := apb.New(&api.CommunitiesAttribute{
+			Communities: c.standard,
+		})
+		path.Pattrs = append(path.Pattrs, attr)
+	}
+
+	large := append([]*api.LargeCommunity{}, c.large...)
+	if mac != "" {
+		large = append(large, b.macMarkers(mac)...)
+	}
+	if len(large) > 0 {
+		attr, _ := apb.New(&api.LargeCommunitiesAttribute{
+			Communities: large,
+		})
+		path.Pattrs = append(path.Pattrs, attr)
+	}
+	return path
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/nokia/srlinux-ndk-go/ndk"
 	"github.com/rs/zerolog"
 	"os/exec"
+	"sort"
 	"strings"
 	"time"
     "os"
@@ -12,6 +16,44 @@ import (
 
 type ConfigurationManager struct {
     vniConfigs map[string]VniConfig
+    bgpConfig  BgpConfig
+    // Network-instance of the agent container, in which its state is published
+    netInst    string
+    traceOptions TraceOptions
+    resolver   *MacVrfResolver
+    // Oper state from network-instance and interface notifications, absent while unknown
+    netInstUp  map[string]bool
+    ipVrfs     map[string]bool
+    intfUp     map[string]bool
+    operStates map[string]string
+    monitor    *VtepMonitor
+    discovery  *MacDiscovery
+    vtepStates map[string]string
+    ethernetSegments map[string]EthernetSegment
+    exportPolicy RoutingPolicy
+    exportStatements map[string]*PolicyStatement
+    importPolicy RoutingPolicy
+    importStatements map[string]*PolicyStatement
+    maxPrefix map[string]MaxPrefixConfig
+    communities Communities
+    // Last data of each message and config of each VRF sent to the BGP Speaker, only changes are sent again
+    sentMessages map[string]string
+    sentVrfs map[string]json.RawMessage
+    // mac-ip and ethernet-tag entries notified before their static VTEP, by <vrf>/<vtep>
+    pendingMacIps map[string]map[string][]string
+    pendingEthernetTags map[string]map[string]EthernetTag
+    // Set between the first config notification of a commit and its commit.end
+    inTransaction bool
+    // Generation and BGP config of the state persisted for a warm start, the messages are the ones sent
+    applied AppliedState
+    // Content of the last saved state, only a commit that changes it is saved
+    savedContent []byte
+    warmStarted bool
+    // Set while NDK replays the configuration to a re-registered agent, until its commit.end
+    replaying bool
+    // Telemetry paths of the oper-states and VTEP states, and the ones published before a replay
+    statePaths map[string]bool
+    staleStatePaths map[string]bool
 	logger       *zerolog.Logger
 }
 
@@ -19,12 +61,60 @@ func NewConfigurationManager(logger *zerolog.Logger) *ConfigurationManager {
     var c ConfigurationManager
 
 	c.vniConfigs = make(map[string]VniConfig)
+    c.resolver = NewMacVrfResolver(logger)
+    c.netInstUp = make(map[string]bool)
+    c.ipVrfs = make(map[string]bool)
+    c.intfUp = make(map[string]bool)
+    c.operStates = make(map[string]string)
+    c.monitor = NewVtepMonitor(logger)
+    c.discovery = NewMacDiscovery(logger)
+    c.vtepStates = make(map[string]string)
+    c.statePaths = make(map[string]bool)
+    c.ethernetSegments = make(map[string]EthernetSegment)
+    c.exportStatements = make(map[string]*PolicyStatement)
+    c.importStatements = make(map[string]*PolicyStatement)
+    c.maxPrefix = make(map[string]MaxPrefixConfig)
+    c.sentMessages = make(map[string]string)
+    c.sentVrfs = make(map[string]json.RawMessage)
+    c.pendingMacIps = make(map[string]map[string][]string)
+    c.pendingEthernetTags = make(map[string]map[string]EthernetTag)
     c.logger = logger
 
     return &c
 }
 
-func (c *ConfigurationManager)processBgpConfig(agent *Agent, op ndk.SdkMgrOperation, bgpc string) {
+func (c *ConfigurationManager)processBgpConfig(agent *Agent, op ndk.SdkMgrOperation, netInst string, bgpc string) {
+	var bgpConfig BgpConfig
+	json.Unmarshal([]byte(bgpc), &bgpConfig)
+	c.applied.NetworkInstance, c.applied.Bgpc = netInst, bgpc
+	agent.metrics.Configure(context.Background(), bgpConfig.Metrics)
+
+	traceOptions := bgpConfig.TraceOptions
+	if traceOptions != c.traceOptions {
+		c.traceOptions = traceOptions
+		applyTraceOptions(c.logger, &traceOptions)
+		c.sendTraceOptions(agent)
+	}
+
+	// The communities are merged into the VTEPs of the next VRF configs, on commit.end
+	var rawjson map[string]interface{}
+	json.Unmarshal([]byte(bgpc), &rawjson)
+	c.communities = getCommunities(rawjson)
+
+	// The policies are sent with the next VRF configs, on commit.end
+	c.exportPolicy.DefaultAction = bgpConfig.ExportPolicy.DefaultAction
+	c.importPolicy.DefaultAction = bgpConfig.ImportPolicy.DefaultAction
+
+	// Only restart the BGP Speaker when its own parameters changed
+	bgpConfig.ExportPolicy.DefaultAction = ""
+	bgpConfig.ImportPolicy.DefaultAction = ""
+	bgpConfig.Metrics = MetricsConfig{}
+	bgpConfig.TraceOptions = TraceOptions{}
+	if bgpConfig == c.bgpConfig && netInst == c.netInst && agent.ChildProcess != nil {
+		return
+	}
+	c.bgpConfig = bgpConfig
+	c.netInst = netInst
 
 	agent.TerminateChildProcess()
 
@@ -40,65 +130,720 @@ func (c *ConfigurationManager)processBgpConfig(agent *Agent, op ndk.SdkMgrOperat
 
 	cmd := exec.Command("ip", "netns", "exec", "srbase-default", "/opt/static-vxlan-agent/bin/static-vxlan-agent", "-c")
 
-	agent.SetChildProcess(cmd)
+	agent.SetChildProcess(cmd, netInst)
+	c.resetSent()
+	c.sendTraceOptions(agent)
 	agent.SendToChildProcess("bgpc", bgpc)
 	// No need to send Configs right now, since this will get done on commit.end
 }
 
-func (c *ConfigurationManager)processVniConfig(op ndk.SdkMgrOperation , conf string, keys []string) {
+func (c *ConfigurationManager)sendTraceOptions(agent *Agent) {
+	if agent.ChildProcess == nil {
+		return
+	}
+	str, _ := json.Marshal(c.traceOptions)
+	agent.SendToChildProcess("trace_options", string(str))
+}
+
+func (c *ConfigurationManager)processVniConfig(agent *Agent, op ndk.SdkMgrOperation , conf string, keys []string) {
+    vrf := keys[0]
+
+	if op == ndk.SdkMgrOperation_Delete {
+		// Deleting the container also deletes all static-vtep entries under it
+		for vtep := range c.vniConfigs[vrf].Vteps {
+			c.deleteVtepState(agent, vrf, keys[1], vtep)
+		}
+		delete(c.vniConfigs, vrf)
+		c.deleteOperState(agent, vrf, keys[1])
+		c.logger.Info().Str("vrf", vrf).Msg("Deleted VNI Config")
+		return
+	}
+
 	var rawjson map[string]interface{}
 	json.Unmarshal([]byte(conf), &rawjson);
 
-    vrf := keys[0]
 	admin_state := rawjson["admin_state"].(string)
-	vni := rawjson["vni"].(map[string]interface{})["value"].(string);
-	evi := rawjson["evi"].(map[string]interface{})["value"].(string);
+	// evi and vni are optional overrides, by default they are derived from the mac-vrf
+	vni, _ := getLeafValue(rawjson, "vni")
+	evi, _ := getLeafValue(rawjson, "evi")
 
 	var vniConfig VniConfig
 	if c, found := c.vniConfigs[vrf]; found {
 		vniConfig = c
 	}
 	vniConfig.AdminState = admin_state
+	vniConfig.BgpInstance = keys[1]
 	vniConfig.Vni = vni
 	vniConfig.Evi = evi
+	vniConfig.StickyMacs = getLeafBool(rawjson, "sticky_macs")
+	vniConfig.Originator, _ = rawjson["originator"].(string)
+	vniConfig.MacDiscovery = MacDiscoveryConfig{}
+	if d, ok := rawjson["mac_discovery"].(map[string]interface{}); ok {
+		vniConfig.MacDiscovery.AdminState, _ = d["admin_state"].(string)
+		interval, _ := getLeafValue(d, "poll_interval")
+		vniConfig.MacDiscovery.PollInterval = getUint32FromJson(interval)
+	}
+	vniConfig.Communities = getCommunities(rawjson)
+	if vniConfig.Vteps == nil {
+		vniConfig.Vteps = make(map[string]Vtep)
+	}
 	c.vniConfigs[vrf] = vniConfig
 
-	c.logger.Info().Msgf("Received VNI Config for VRF %s. admin_state: %s, vni: %s, evi: %s", vrf, admin_state, vni, evi)
+	c.logger.Info().Str("vrf", vrf).Str("admin_state", admin_state).Str("vni", vni).Str("evi", evi).Msg("Received VNI Config")
 	// No need to send Configs right now, since this will get done on commit.end
 }
 
 func (c *ConfigurationManager)processCommitEnd(agent *Agent) {
-	str, _ := json.Marshal(c.vniConfigs)
-	c.logger.Info().Msgf("Configs: %s", string(str))
+	probes := make(map[string]VtepReachability)
+	for vrf, vniConfig := range c.vniConfigs {
+		for address, vtep := range vniConfig.Vteps {
+			probes[probeKey(vrf, address)] = vtep.Reachability
+		}
+	}
+	c.monitor.SyncProbes(probes)
+
+	discovery := make(map[string]MacDiscoveryConfig)
+	for vrf, vniConfig := range c.vniConfigs {
+		discovery[vrf] = vniConfig.MacDiscovery
+	}
+	c.discovery.Sync(discovery)
+
+	resolve := make(map[string]string)
+	for vrf, vniConfig := range c.vniConfigs {
+		if vniConfig.Evi == "" || vniConfig.Vni == "" {
+			resolve[vrf] = vniConfig.BgpInstance
+		}
+	}
+	c.resolver.Sync(resolve)
+
+	// The BGP Speaker applies the ethernet segments and policies together with the next VRF configs
+	segments, _ := json.Marshal(c.ethernetSegments)
+	c.sendChanged(agent, "es", string(segments))
+
+	c.sendPolicy(agent, "export_policy", &c.exportPolicy, c.exportStatements)
+	c.sendPolicy(agent, "import_policy", &c.importPolicy, c.importStatements)
+
+	limits, _ := json.Marshal(c.maxPrefix)
+	c.sendChanged(agent, "max_prefix", string(limits))
+
+	c.sendVrfConfigs(agent, c.effectiveVniConfigs(agent))
+}
+
+// sendChanged sends a message to the BGP Speaker, unless it has the same data already
+func (c *ConfigurationManager)sendChanged(agent *Agent, key string, data string) {
+	if sent, found := c.sentMessages[key]; found && sent == data {
+		return
+	}
+	c.sentMessages[key] = data
+	agent.SendToChildProcess(key, data)
+}
+
+// sendVrfConfigs sends the configs of the VRFs that changed since they were last sent to the BGP Speaker, and null
+// for the ones that are gone. The message is sent even without changes, as it applies the messages before it
+func (c *ConfigurationManager)sendVrfConfigs(agent *Agent, configs map[string]VniConfig) {
+	delta := make(map[string]json.RawMessage)
+	for vrf, config := range configs {
+		str, _ := json.Marshal(config)
+		if !bytes.Equal(str, c.sentVrfs[vrf]) {
+			delta[vrf] = str
+			c.sentVrfs[vrf] = str
+		}
+	}
+	for vrf := range c.sentVrfs {
+		if _, found := configs[vrf]; !found {
+			delta[vrf] = json.RawMessage("null")
+			delete(c.sentVrfs, vrf)
+		}
+	}
+
+	str, _ := json.Marshal(delta)
+	c.logger.Info().Int("vrfs", len(configs)).RawJSON("changed", str).Msg("Configs")
 	agent.SendToChildProcess("vrf", string(str))
 }
 
-func (c *ConfigurationManager)processVtepConfig(op ndk.SdkMgrOperation, conf string, keys []string) {
+// resetSent forgets what was sent to the BGP Speaker, so the next commit sends all of it
+func (c *ConfigurationManager)resetSent() {
+	c.sentMessages = make(map[string]string)
+	c.sentVrfs = make(map[string]json.RawMessage)
+}
+
+// resync forgets the configuration before NDK replays it to the re-registered agent, so that what was deleted while
+// the NDK manager was down gets withdrawn. The BGP Speaker keeps its routes until the commit.end of the replay
+func (c *ConfigurationManager)resync() {
+	c.vniConfigs = make(map[string]VniConfig)
+	c.ethernetSegments = make(map[string]EthernetSegment)
+	c.exportStatements = make(map[string]*PolicyStatement)
+	c.importStatements = make(map[string]*PolicyStatement)
+	c.maxPrefix = make(map[string]MaxPrefixConfig)
+	c.pendingMacIps = make(map[string]map[string][]string)
+	c.pendingEthernetTags = make(map[string]map[string]EthernetTag)
+	c.replaying = true
+	// Reachability and discovery events don't apply a partially replayed configuration
+	c.inTransaction = true
+
+	// NDK lost the telemetry too, it gets published again after the replay and what wasn't is dropped then
+	c.operStates = make(map[string]string)
+	c.vtepStates = make(map[string]string)
+	for jsPath := range c.staleStatePaths {
+		// Another resync before the commit.end of the previous replay
+		c.statePaths[jsPath] = true
+	}
+	c.staleStatePaths = c.statePaths
+	c.statePaths = make(map[string]bool)
+}
+
+// dropStaleState deletes the oper-states and VTEP states that weren't published again by the replay
+func (c *ConfigurationManager)dropStaleState(agent *Agent) {
+	for jsPath := range c.staleStatePaths {
+		if !c.statePaths[jsPath] {
+			c.logger.Info().Str("path", jsPath).Msg("Dropping state deleted while the NDK manager was down")
+			agent.deleteTelemetry(jsPath)
+		}
+	}
+	c.staleStatePaths = nil
+}
+
+// effectiveVniConfigs fills in the EVI and VNI of the mac-vrfs and ip-vrfs that don't set them explicitly.
+// A VRF for which they can't be resolved, or that is operationally down, is left out so its routes get withdrawn
+func (c *ConfigurationManager)effectiveVniConfigs(agent *Agent) map[string]VniConfig {
+	configs := make(map[string]VniConfig)
+	for vrf, vniConfig := range c.vniConfigs {
+		// NDK reports ip-vrfs as L3VRF network-instances. Before it did, only VTEPs of an ip-vrf have a router-mac
+		vniConfig.Type = "mac-vrf"
+		if isIpVrf, found := c.ipVrfs[vrf]; found {
+			if isIpVrf {
+				vniConfig.Type = "ip-vrf"
+			}
+		} else {
+			for _, vtep := range vniConfig.Vteps {
+				if vtep.RouterMac != "" {
+					vniConfig.Type = "ip-vrf"
+				}
+			}
+		}
+
+		// Only what isn't configured is resolved
+		var info MacVrfInfo
+		if vniConfig.Evi == "" || vniConfig.Vni == "" {
+			var err error
+			info, err = c.resolver.Lookup(vrf)
+			if err == errNoVxlanInterface {
+				c.publishOperState(agent, vrf, &vniConfig, "down", vniConfig.Type+" has no vxlan-interface")
+				continue
+			}
+			if err == errUnresolved {
+				c.publishOperState(agent, vrf, &vniConfig, "down", "resolving EVI and VNI of the "+vniConfig.Type)
+				continue
+			}
+			if err != nil {
+				c.logger.Warn().Err(err).Str("vrf", vrf).Msg("Can't resolve EVI and VNI, not advertising routes")
+				c.publishOperState(agent, vrf, &vniConfig, "down", "EVI or VNI of the "+vniConfig.Type+" unknown")
+				continue
+			}
+			if vniConfig.Evi == "" {
+				vniConfig.Evi = info.Evi
+			}
+			if vniConfig.Vni == "" {
+				vniConfig.Vni = info.Vni
+			}
+		}
+
+		if reason := c.invalidOriginator(&vniConfig); reason != "" {
+			c.publishOperState(agent, vrf, &vniConfig, "down", reason)
+			continue
+		}
+
+		if up, found := c.netInstUp[vrf]; found && !up {
+			c.publishOperState(agent, vrf, &vniConfig, "down", vniConfig.Type+" is operationally down")
+			continue
+		}
+		if info.VxlanInterface != "" {
+			if up, found := c.intfUp[info.VxlanInterface]; found && !up {
+				c.publishOperState(agent, vrf, &vniConfig, "down", "vxlan-interface "+info.VxlanInterface+" is down or missing")
+				continue
+			}
+		}
+
+		c.publishOperState(agent, vrf, &vniConfig, "up", "")
+
+		// Leave out the VTEPs found unreachable, so their routes get withdrawn
+		vteps := make(map[string]Vtep)
+		for address, vtep := range vniConfig.Vteps {
+			state := c.monitor.Reachability(vrf, address, vtep.Reachability)
+			c.publishVtepState(agent, vrf, &vniConfig, address, state)
+			if state != unreachable {
+				vtep.DiscoveredMacs = c.discovery.Macs(vrf, address)
+				vtep.Communities = mergeCommunities(c.communities, vniConfig.Communities, vtep.Communities)
+				vteps[address] = vtep
+			}
+		}
+		vniConfig.Vteps = vteps
+		configs[vrf] = vniConfig
+	}
+	return configs
+}
+
+// invalidOriginator returns why the routes of a VRF can't be originated by the agent's router-id, if so.
+// They would all have the same route distinguisher, so routes of different VTEPs can't be told apart
+func (c *ConfigurationManager)invalidOriginator(vniConfig *VniConfig) string {
+	if strings.TrimPrefix(vniConfig.Originator, "ORIGINATOR_") != "router_id" {
+		return ""
+	}
+	if len(vniConfig.Vteps) > 1 {
+		return "originator router-id requires a single static-vtep"
+	}
+	for name, es := range c.ethernetSegments {
+		for _, vtep := range es.Vteps {
+			if _, found := vniConfig.Vteps[vtep]; found {
+				return "originator router-id doesn't support multi-homed VTEPs, " + vtep + " is in ethernet-segment " + name
+			}
+		}
+	}
+	return ""
+}
+
+func (c *ConfigurationManager)publishVtepState(agent *Agent, vrf string, vniConfig *VniConfig, vtep string, state string) {
+	key := vrf + "/" + vtep
+	if c.vtepStates[key] == state {
+		return
+	}
+	c.vtepStates[key] = state
+
+	jsPath := vtepStatePath(vrf, vniConfig.BgpInstance, vtep)
+	if state == "" {
+		// No longer monitored
+		delete(c.statePaths, jsPath)
+		agent.deleteTelemetry(jsPath)
+		return
+	}
+	c.statePaths[jsPath] = true
+	c.logger.Info().Str("vrf", vrf).Str("vtep", vtep).Str("reachability", state).Msg("VTEP reachability changed")
+	agent.updateTelemetry(jsPath, map[string]string{"state": state})
+}
+
+// deleteVtepState removes the reachability of a VTEP that is no longer configured, and stops probing it
+func (c *ConfigurationManager)deleteVtepState(agent *Agent, vrf string, bgpInstance string, vtep string) {
+	c.monitor.StopProbe(vrf, vtep)
+	key := vrf + "/" + vtep
+	if _, found := c.vtepStates[key]; !found {
+		return
+	}
+	delete(c.vtepStates, key)
+	jsPath := vtepStatePath(vrf, bgpInstance, vtep)
+	delete(c.statePaths, jsPath)
+	agent.deleteTelemetry(jsPath)
+}
+
+func vtepStatePath(vrf string, bgpInstance string, vtep string) string {
+	return fmt.Sprintf(".network_instance{.name==\"%s\"}.protocols.bgp_evpn.bgp_instance{.id==%s}.static_vxlan_agent.static_vtep{.vtep_ip==\"%s\"}.reachability", vrf, bgpInstance, vtep)
+}
+
+// reachabilityChanged tells whether any monitored VTEP changed state since routes were last computed
+func (c *ConfigurationManager)reachabilityChanged() bool {
+	for vrf, vniConfig := range c.vniConfigs {
+		for address, vtep := range vniConfig.Vteps {
+			if state, found := c.vtepStates[vrf+"/"+address]; found && state != c.monitor.Reachability(vrf, address, vtep.Reachability) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *ConfigurationManager)processRoute(agent *Agent, n *ndk.IpRouteNotification) {
+	if c.monitor.ProcessRoute(n) && c.reachabilityChanged() {
+		c.processStateChange(agent)
+	}
+}
+
+func (c *ConfigurationManager)processBfdSession(agent *Agent, n *ndk.BfdSessionNotification) {
+	if c.monitor.ProcessBfd(n) && c.reachabilityChanged() {
+		c.processStateChange(agent)
+	}
+}
+
+func (c *ConfigurationManager)processVtepEvent(agent *Agent, vtep string) {
+	c.processStateChange(agent)
+}
+
+func (c *ConfigurationManager)processMacDiscoveryEvent(agent *Agent, vrf string) {
+	if _, found := c.vniConfigs[vrf]; found {
+		c.processStateChange(agent)
+	}
+}
+
+// publishOperState updates the oper-state of the agent in a mac-vrf or ip-vrf, if it changed
+func (c *ConfigurationManager)publishOperState(agent *Agent, vrf string, vniConfig *VniConfig, state string, reason string) {
+	current := state + reason
+	if c.operStates[vrf] == current {
+		return
+	}
+	c.operStates[vrf] = current
+	c.logger.Info().Str("vrf", vrf).Str("oper-state", state).Str("reason", reason).Msg("Network-instance oper-state changed")
+
+	jsPath := operStatePath(vrf, vniConfig.BgpInstance)
+	c.statePaths[jsPath] = true
+	agent.updateTelemetry(jsPath, map[string]string{
+		"oper_state":       state,
+		"oper_down_reason": reason,
+	})
+}
+
+// deleteOperState removes the oper-state of the agent from a mac-vrf it is no longer configured in
+func (c *ConfigurationManager)deleteOperState(agent *Agent, vrf string, bgpInstance string) {
+	if _, found := c.operStates[vrf]; !found {
+		return
+	}
+	delete(c.operStates, vrf)
+	jsPath := operStatePath(vrf, bgpInstance)
+	delete(c.statePaths, jsPath)
+	agent.deleteTelemetry(jsPath)
+}
+
+func operStatePath(vrf string, bgpInstance string) string {
+	return fmt.Sprintf(".network_instance{.name==\"%s\"}.protocols.bgp_evpn.bgp_instance{.id==%s}.static_vxlan_agent", vrf, bgpInstance)
+}
+
+func (c *ConfigurationManager)processNetworkInstance(agent *Agent, n *ndk.NetworkInstanceNotification) {
+	vrf := n.GetKey().GetInstName()
+	if n.GetOp() == ndk.SdkMgrOperation_Delete {
+		delete(c.netInstUp, vrf)
+		delete(c.ipVrfs, vrf)
+	} else {
+		c.netInstUp[vrf] = n.GetData().GetOperIsUp()
+		c.ipVrfs[vrf] = n.GetData().GetInstType() == ndk.NetworkInstanceData_L3VRF
+	}
+	if _, found := c.vniConfigs[vrf]; !found {
+		return
+	}
+
+	c.logger.Info().Str("vrf", vrf).Str("op", n.GetOp().String()).Bool("oper-up", n.GetData().GetOperIsUp()).Msg("Received network-instance notification")
+	// The EVI or vxlan-interface may have changed along
+	c.resolver.Refresh()
+	c.processStateChange(agent)
+}
+
+func (c *ConfigurationManager)processInterface(agent *Agent, n *ndk.InterfaceNotification) {
+	name := n.GetKey().GetIfName()
+	if n.GetOp() == ndk.SdkMgrOperation_Delete {
+		c.intfUp[name] = false
+	} else {
+		c.intfUp[name] = n.GetData().GetOperIsUp() != 0
+	}
+	if !c.resolver.UsesInterface(name) {
+		return
+	}
+
+	c.logger.Info().Str("interface", name).Str("op", n.GetOp().String()).Bool("oper-up", c.intfUp[name]).Msg("Received vxlan-interface notification")
+	c.resolver.Refresh()
+	c.processStateChange(agent)
+}
+
+// processStateChange applies the configuration again after the state of the network changed. In the middle of a
+// commit this is left to its commit.end, so that a partial configuration never reaches the BGP Speaker
+func (c *ConfigurationManager)processStateChange(agent *Agent) {
+	if c.inTransaction {
+		return
+	}
+	c.processCommitEnd(agent)
+}
+
+func (c *ConfigurationManager)processResolverEvent(agent *Agent) {
+	c.processStateChange(agent)
+}
+
+func (c *ConfigurationManager)processToolsCommand(agent *Agent, conf string) {
+	var rawjson map[string]interface{}
+	json.Unmarshal([]byte(conf), &rawjson);
+
+	var cmds []ToolsCommand
+	if _, found := rawjson["reset_peer"]; found {
+		cmds = append(cmds, ToolsCommand{Action: "reset-peer"})
+	}
+	if _, found := rawjson["soft_clear"]; found {
+		cmds = append(cmds, ToolsCommand{Action: "soft-clear"})
+	}
+	if _, found := rawjson["resync_from_config"]; found {
+		c.logger.Info().Msg("Resync routes from config")
+		c.resolver.Refresh()
+		// The BGP Speaker only programs changes, so first make it rebuild its view of the originated routes.
+		// It then gets the configs of all VRFs again
+		str, _ := json.Marshal(ToolsCommand{Action: "resync"})
+		agent.SendToChildProcess("tools", string(str))
+		c.resetSent()
+		c.processCommitEnd(agent)
+	}
+	if file, found := rawjson["dump_rib_to_file"].(map[string]interface{}); found {
+		if v, ok := file["value"].(string); ok {
+			cmds = append(cmds, ToolsCommand{Action: "dump-rib", File: v})
+		}
+	}
+
+	for _, cmd := range cmds {
+		c.logger.Info().Str("action", cmd.Action).Msg("Forwarding tools command to BGP Speaker")
+		str, _ := json.Marshal(cmd)
+		agent.SendToChildProcess("tools", string(str))
+	}
+}
+
+func (c *ConfigurationManager)processVtepConfig(agent *Agent, op ndk.SdkMgrOperation, conf string, keys []string) {
 	vrf := keys[0]
 	vtep := keys[2]
 
+	vniConfig, found := c.vniConfigs[vrf]
+	if !found {
+		vniConfig.Vteps = make(map[string]Vtep)
+	}
+
 	if ((op == ndk.SdkMgrOperation_Create) || (op == ndk.SdkMgrOperation_Change)) {
-		var vniConfig VniConfig
-		if item, found := c.vniConfigs[vrf]; found {
-			vniConfig = item
+		var rawjson map[string]interface{}
+		json.Unmarshal([]byte(conf), &rawjson);
+
+		// A Change carries the full list entry, so replace all attributes except the child lists
+		v := Vtep{Address: vtep, MacIps: vniConfig.Vteps[vtep].MacIps, EthernetTags: vniConfig.Vteps[vtep].EthernetTags}
+		if macIps, found := c.pendingMacIps[vrf+"/"+vtep]; found {
+			v.MacIps = macIps
+			delete(c.pendingMacIps, vrf+"/"+vtep)
+		}
+		if tags, found := c.pendingEthernetTags[vrf+"/"+vtep]; found {
+			v.EthernetTags = tags
+			delete(c.pendingEthernetTags, vrf+"/"+vtep)
 		}
-		v := Vtep{Address: vtep}
-		vniConfig.Vteps = append(vniConfig.Vteps, v)
+		v.StaticMacs = getLeafList(rawjson, "static_macs")
+		v.RouterMac, _ = getLeafValue(rawjson, "router_mac")
+		v.IpPrefixes = getLeafList(rawjson, "ip_prefix")
+		v.Communities = getCommunities(rawjson)
+		if r, ok := rawjson["reachability"].(map[string]interface{}); ok {
+			v.Reachability.Monitoring, _ = r["monitoring"].(string)
+			interval, _ := getLeafValue(r, "probe_interval")
+			v.Reachability.ProbeInterval = getUint32FromJson(interval)
+			threshold, _ := getLeafValue(r, "failure_threshold")
+			v.Reachability.FailureThreshold = getUint32FromJson(threshold)
+		}
+		if f, ok := rawjson["flooding"].(map[string]interface{}); ok {
+			v.Flooding.SuppressImet = getLeafBool(f, "suppress_imet")
+			v.Flooding.PmsiTunnelType, _ = f["pmsi_tunnel_type"].(string)
+			v.Flooding.LeafInfoRequired = getLeafBool(f, "leaf_information_required")
+			v.Flooding.MulticastGroup, _ = getLeafValue(f, "multicast_group")
+		}
+		vniConfig.Vteps[vtep] = v
 		c.vniConfigs[vrf] = vniConfig
-	} else if op == ndk.SdkMgrOperation_Delete {
-		if item, found := c.vniConfigs[vrf]; found {
-			for i, v := range item.Vteps {
-				if v.Address == vtep {
-					item.Vteps = append(item.Vteps[:i], item.Vteps[i+1:]...)
-					break
-				}
+	} else if op == ndk.SdkMgrOperation_Delete && found {
+		delete(vniConfig.Vteps, vtep)
+		c.deleteVtepState(agent, vrf, keys[1], vtep)
+	}
+
+	c.logger.Info().Str("vrf", vrf).Str("vtep", vtep).Msg("Received VTep Config")
+	// No need to send Configs right now, since this will get done on commit.end
+}
+
+func (c *ConfigurationManager)processEthernetSegmentConfig(op ndk.SdkMgrOperation, conf string, keys []string) {
+	name := keys[1]
+
+	if op == ndk.SdkMgrOperation_Delete {
+		delete(c.ethernetSegments, name)
+		c.logger.Info().Str("ethernet-segment", name).Msg("Deleted Ethernet Segment Config")
+		return
+	}
+
+	var rawjson map[string]interface{}
+	json.Unmarshal([]byte(conf), &rawjson);
+
+	var es EthernetSegment
+	es.Esi, _ = getLeafValue(rawjson, "esi")
+	es.MultiHomingMode, _ = rawjson["multi_homing_mode"].(string)
+	es.Vteps = getLeafList(rawjson, "vtep")
+	c.ethernetSegments[name] = es
+
+	c.logger.Info().Str("ethernet-segment", name).Str("esi", es.Esi).Str("mode", es.MultiHomingMode).Strs("vteps", es.Vteps).Msg("Received Ethernet Segment Config")
+	// No need to send Configs right now, since this will get done on commit.end
+}
+
+func (c *ConfigurationManager)processMacIpConfig(op ndk.SdkMgrOperation, conf string, keys []string) {
+	vrf := keys[0]
+	address := keys[2]
+	mac := keys[3]
+
+	// NDK may notify the entry before its VTEP, it is then kept until the VTEP arrives
+	vtep, found := c.vniConfigs[vrf].Vteps[address]
+	current := vtep.MacIps
+	if !found {
+		current = c.pendingMacIps[vrf+"/"+address]
+	}
+
+	macIps := make(map[string][]string)
+	for m, ips := range current {
+		macIps[m] = ips
+	}
+	if op == ndk.SdkMgrOperation_Delete {
+		delete(macIps, mac)
+	} else {
+		var rawjson map[string]interface{}
+		json.Unmarshal([]byte(conf), &rawjson);
+		macIps[mac] = getLeafList(rawjson, "ip_address")
+	}
+
+	if !found && len(macIps) > 0 {
+		c.pendingMacIps[vrf+"/"+address] = macIps
+	} else if !found {
+		delete(c.pendingMacIps, vrf+"/"+address)
+	} else {
+		vtep.MacIps = macIps
+		c.vniConfigs[vrf].Vteps[address] = vtep
+	}
+
+	c.logger.Info().Str("vrf", vrf).Str("vtep", address).Str("mac", mac).Strs("ips", macIps[mac]).Msg("Received MAC-IP Config")
+	// No need to send Configs right now, since this will get done on commit.end
+}
+
+func (c *ConfigurationManager)processEthernetTagConfig(op ndk.SdkMgrOperation, conf string, keys []string) {
+	vrf := keys[0]
+	address := keys[2]
+	id := keys[3]
+
+	// NDK may notify the entry before its VTEP, it is then kept until the VTEP arrives
+	vtep, found := c.vniConfigs[vrf].Vteps[address]
+	current := vtep.EthernetTags
+	if !found {
+		current = c.pendingEthernetTags[vrf+"/"+address]
+	}
+
+	tags := make(map[string]EthernetTag)
+	for t, tag := range current {
+		tags[t] = tag
+	}
+	if op == ndk.SdkMgrOperation_Delete {
+		delete(tags, id)
+	} else {
+		var rawjson map[string]interface{}
+		json.Unmarshal([]byte(conf), &rawjson);
+		var tag EthernetTag
+		tag.Vni, _ = getLeafValue(rawjson, "vni")
+		tag.StaticMacs = getLeafList(rawjson, "static_macs")
+		tags[id] = tag
+	}
+
+	if !found && len(tags) > 0 {
+		c.pendingEthernetTags[vrf+"/"+address] = tags
+	} else if !found {
+		delete(c.pendingEthernetTags, vrf+"/"+address)
+	} else {
+		vtep.EthernetTags = tags
+		c.vniConfigs[vrf].Vteps[address] = vtep
+	}
+
+	c.logger.Info().Str("vrf", vrf).Str("vtep", address).Str("ethernet-tag", id).Str("vni", tags[id].Vni).Msg("Received Ethernet Tag Config")
+	// No need to send Configs right now, since this will get done on commit.end
+}
+
+func (c *ConfigurationManager)sendPolicy(agent *Agent, key string, policy *RoutingPolicy, statements map[string]*PolicyStatement) {
+	policy.Statements = []*PolicyStatement{}
+	for _, statement := range statements {
+		policy.Statements = append(policy.Statements, statement)
+	}
+	// In a stable order, so an unchanged policy isn't sent again
+	sort.Slice(policy.Statements, func(i, j int) bool { return policy.Statements[i].SequenceId < policy.Statements[j].SequenceId })
+	str, _ := json.Marshal(policy)
+	c.sendChanged(agent, key, string(str))
+}
+
+func (c *ConfigurationManager)processPolicyStatementConfig(statements map[string]*PolicyStatement, op ndk.SdkMgrOperation, conf string, keys []string) {
+	seq := keys[1]
+
+	if op == ndk.SdkMgrOperation_Delete {
+		delete(statements, seq)
+		c.logger.Info().Str("sequence-id", seq).Msg("Deleted policy statement")
+		return
+	}
+
+	var rawjson map[string]interface{}
+	json.Unmarshal([]byte(conf), &rawjson);
+
+	statement := &PolicyStatement{SequenceId: getUint32FromJson(seq)}
+	if m, ok := rawjson["match"].(map[string]interface{}); ok {
+		statement.MacVrf, _ = getLeafValue(m, "mac_vrf")
+		statement.Vtep, _ = getLeafValue(m, "vtep")
+		statement.MacAddress, _ = getLeafValue(m, "mac_address")
+	}
+	if a, ok := rawjson["action"].(map[string]interface{}); ok {
+		statement.Result, _ = a["policy_result"].(string)
+		statement.AddCommunities = getLeafList(a, "add_community")
+		statement.LocalPreference, _ = getLeafValue(a, "local_preference")
+		statement.Med, _ = getLeafValue(a, "med")
+	}
+	statements[seq] = statement
+
+	c.logger.Info().Str("sequence-id", seq).Interface("statement", statement).Msg("Received policy statement")
+	// No need to send Configs right now, since this will get done on commit.end
+}
+
+func (c *ConfigurationManager)processMaxPrefixConfig(op ndk.SdkMgrOperation, conf string, keys []string) {
+	family := strings.TrimPrefix(keys[1], "AFI_SAFI_")
+
+	if op == ndk.SdkMgrOperation_Delete {
+		delete(c.maxPrefix, family)
+		c.logger.Info().Str("family", family).Msg("Deleted max-prefix")
+		return
+	}
+
+	var rawjson map[string]interface{}
+	json.Unmarshal([]byte(conf), &rawjson);
+
+	var limit MaxPrefixConfig
+	max, _ := getLeafValue(rawjson, "max_received_routes")
+	limit.MaxRoutes = getUint32FromJson(max)
+	pct, _ := getLeafValue(rawjson, "warning_threshold_pct")
+	limit.WarningThresholdPct = getUint32FromJson(pct)
+	limit.Action, _ = rawjson["action"].(string)
+	interval, _ := getLeafValue(rawjson, "restart_interval")
+	limit.RestartInterval = getUint32FromJson(interval)
+	c.maxPrefix[family] = limit
+
+	c.logger.Info().Str("family", family).Interface("max-prefix", limit).Msg("Received max-prefix")
+	// No need to send Configs right now, since this will get done on commit.end
+}
+
+// getLeafValue returns the value of a leaf encoded by NDK as {"value": ...}
+func getLeafValue(rawjson map[string]interface{}, name string) (string, bool) {
+	if m, ok := rawjson[name].(map[string]interface{}); ok {
+		v, ok := m["value"].(string)
+		return v, ok
+	}
+	return "", false
+}
+
+// getLeafBool returns the value of a boolean leaf encoded by NDK as {"value": true}
+func getLeafBool(rawjson map[string]interface{}, name string) bool {
+	if m, ok := rawjson[name].(map[string]interface{}); ok {
+		v, _ := m["value"].(bool)
+		return v
+	}
+	return false
+}
+
+// getLeafList returns the values of a leaf-list encoded by NDK as [{"value": ...}, ...]
+func getLeafList(rawjson map[string]interface{}, name string) []string {
+	var values []string
+	items, _ := rawjson[name].([]interface{})
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			if v, ok := m["value"].(string); ok {
+				values = append(values, v)
 			}
-			c.vniConfigs[vrf] = item
 		}
 	}
+	return values
+}
 
-	c.logger.Info().Msgf("Received VTep Config for VRF %s. vtep: %s", vrf, vtep)
-	// No need to send Configs right now, since this will get done on commit.end
+// getCommunities returns the communities configured in the communities container of a list entry
+func getCommunities(rawjson map[string]interface{}) Communities {
+	var communities Communities
+	if m, ok := rawjson["communities"].(map[string]interface{}); ok {
+		communities.Standard = getLeafList(m, "standard")
+		communities.Extended = getLeafList(m, "extended")
+		communities.Large = getLeafList(m, "large")
+	}
+	return communities
 }
 
 func (c *ConfigurationManager)processNotification(agent *Agent, n *ndk.ConfigNotification) {
@@ -106,15 +851,41 @@ func (c *ConfigurationManager)processNotification(agent *Agent, n *ndk.ConfigNot
 	op := n.GetOp()
     conf := n.GetData().GetJson()
     key := n.GetKey().JsPath
-	c.logger.Info().Msgf("Received notifications: %v", n)
+	c.logger.Debug().Str("op", op.String()).Str("path", key).Strs("keys", n.GetKey().Keys).Str("data", conf).Msg("Received notification")
+	agent.metrics.ConfigNotification(key)
+
+    if key != ".commit.end" && !strings.HasPrefix(key, ".tools.") {
+        c.inTransaction = true
+    }
 
     if key == ".network_instance.protocols.static_vxlan_agent" {
-        c.processBgpConfig(agent, op, strings.ReplaceAll(conf,"\n",""))
+        c.processBgpConfig(agent, op, n.GetKey().Keys[0], strings.ReplaceAll(conf,"\n",""))
 	} else if key == ".network_instance.protocols.bgp_evpn.bgp_instance.static_vxlan_agent" {
-		c.processVniConfig(op, strings.ReplaceAll(conf,"\n",""),  n.GetKey().Keys)
+		c.processVniConfig(agent, op, strings.ReplaceAll(conf,"\n",""),  n.GetKey().Keys)
 	} else if key == ".network_instance.protocols.bgp_evpn.bgp_instance.static_vxlan_agent.static_vtep" {
-		c.processVtepConfig(op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
+		c.processVtepConfig(agent, op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
+	} else if key == ".network_instance.protocols.bgp_evpn.bgp_instance.static_vxlan_agent.static_vtep.mac_ip" {
+		c.processMacIpConfig(op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
+	} else if key == ".network_instance.protocols.bgp_evpn.bgp_instance.static_vxlan_agent.static_vtep.ethernet_tag" {
+		c.processEthernetTagConfig(op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
+	} else if key == ".network_instance.protocols.static_vxlan_agent.export_policy.statement" {
+		c.processPolicyStatementConfig(c.exportStatements, op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
+	} else if key == ".network_instance.protocols.static_vxlan_agent.import_policy.statement" {
+		c.processPolicyStatementConfig(c.importStatements, op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
+	} else if key == ".network_instance.protocols.static_vxlan_agent.max_prefix" {
+		c.processMaxPrefixConfig(op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
+	} else if key == ".network_instance.protocols.static_vxlan_agent.ethernet_segment" {
+		c.processEthernetSegmentConfig(op, strings.ReplaceAll(conf,"\n",""), n.GetKey().Keys)
 	} else if key == ".commit.end" {
+		replayed := c.replaying
+		c.inTransaction = false
+		c.replaying = false
 		c.processCommitEnd(agent)
+		c.commitApplied()
+		if replayed {
+			c.dropStaleState(agent)
+		}
+	} else if key == ".tools.network_instance.protocols.static_vxlan_agent" {
+		c.processToolsCommand(agent, strings.ReplaceAll(conf,"\n",""))
 	}
 }
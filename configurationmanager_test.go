@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+	"github.com/rs/zerolog"
+)
+
+// testChildStdin captures the messages the agent sends to the BGP Speaker
+type testChildStdin struct {
+	bytes.Buffer
+}
+
+func (w *testChildStdin) Close() error {
+	return nil
+}
+
+// messages returns the data of the messages sent with a key, in order
+func (w *testChildStdin) messages(t *testing.T, key string) []json.RawMessage {
+	var data []json.RawMessage
+	reader := newMessageReader(bytes.NewReader(w.Bytes()), maxMessageSize)
+	for {
+		line, err := reader.Next()
+		if err == io.EOF {
+			return data
+		} else if err != nil {
+			t.Fatalf("can't read message: %v", err)
+		}
+		var msg struct {
+			Key  string          `json:"key"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			t.Fatalf("invalid message %s: %v", line, err)
+		}
+		if msg.Key == key {
+			data = append(data, msg.Data)
+		}
+	}
+}
+
+func newTestConfigurationManager(t testing.TB) (*ConfigurationManager, *Agent, *testChildStdin) {
+	// Don't warm-start a real agent with the state of a test
+	t.Setenv("STATIC_VXLAN_AGENT_STATE_FILE", "")
+
+	logger := zerolog.Nop()
+	stdin := &testChildStdin{}
+	agent := &Agent{
+		metrics:                NewMetrics(&logger),
+		logger:                 &logger,
+		telemetryCtx:           context.Background(),
+		telemetry:              make(map[string]string),
+		TelemetryServiceClient: &testTelemetry{},
+		ChildStdin:             stdin,
+	}
+	return NewConfigurationManager(&logger), agent, stdin
+}
+
+func configNotification(op ndk.SdkMgrOperation, path string, keys []string, data string) *ndk.ConfigNotification {
+	return &ndk.ConfigNotification{
+		Op:   op,
+		Key:  &ndk.ConfigKey{JsPath: path, Keys: keys},
+		Data: &ndk.ConfigData{Json: data},
+	}
+}
+
+const (
+	vniConfigPath         = ".network_instance.protocols.bgp_evpn.bgp_instance.static_vxlan_agent"
+	vtepConfigPath        = vniConfigPath + ".static_vtep"
+	macIpConfigPath       = vtepConfigPath + ".mac_ip"
+	ethernetTagConfigPath = vtepConfigPath + ".ethernet_tag"
+)
+
+var commitEnd = configNotification(ndk.SdkMgrOperation_Create, ".commit.end", nil, "")
+
+// lastVrfMessage returns the VRF configs of the last commit sent to the BGP Speaker, nil for the deleted ones
+func lastVrfMessage(t *testing.T, stdin *testChildStdin) map[string]*VniConfig {
+	messages := stdin.messages(t, "vrf")
+	if len(messages) == 0 {
+		t.Fatal("no vrf message sent")
+	}
+	var configs map[string]*VniConfig
+	if err := json.Unmarshal(messages[len(messages)-1], &configs); err != nil {
+		t.Fatalf("invalid vrf message: %v", err)
+	}
+	return configs
+}
+
+func TestProcessNotification(t *testing.T) {
+	vrf := []string{"mac-vrf-1", "1"}
+	vtep := []string{"mac-vrf-1", "1", "1.1.1.1"}
+	mac := []string{"mac-vrf-1", "1", "1.1.1.1", "00:00:00:00:00:01"}
+	tag := []string{"mac-vrf-1", "1", "1.1.1.1", "100"}
+	vniConfig := `{"admin_state": "ADMIN_STATE_enable", "evi": {"value": "1"}, "vni": {"value": "10"}}`
+	vtepConfig := `{"static_macs": [{"value": "00:00:00:00:00:02"}]}`
+
+	tests := []struct {
+		name          string
+		notifications []*ndk.ConfigNotification
+		// Static MACs, bound MACs and ethernet tags sent for VTEP 1.1.1.1 of mac-vrf-1, nil when it isn't sent
+		staticMacs   []string
+		macIps       map[string][]string
+		ethernetTags []string
+	}{
+		{
+			name: "VTEP",
+			notifications: []*ndk.ConfigNotification{
+				configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, vrf, vniConfig),
+				configNotification(ndk.SdkMgrOperation_Create, vtepConfigPath, vtep, vtepConfig),
+			},
+			staticMacs: []string{"00:00:00:00:00:02"},
+		},
+		{
+			name: "VTEP deleted",
+			notifications: []*ndk.ConfigNotification{
+				configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, vrf, vniConfig),
+				configNotification(ndk.SdkMgrOperation_Create, vtepConfigPath, vtep, vtepConfig),
+				configNotification(ndk.SdkMgrOperation_Delete, vtepConfigPath, vtep, ""),
+			},
+		},
+		{
+			name: "MAC-IP after its VTEP",
+			notifications: []*ndk.ConfigNotification{
+				configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, vrf, vniConfig),
+				configNotification(ndk.SdkMgrOperation_Create, vtepConfigPath, vtep, vtepConfig),
+				configNotification(ndk.SdkMgrOperation_Create, macIpConfigPath, mac, `{"ip_address": [{"value": "10.0.0.1"}]}`),
+			},
+			staticMacs: []string{"00:00:00:00:00:02"},
+			macIps:     map[string][]string{"00:00:00:00:00:01": {"10.0.0.1"}},
+		},
+		{
+			name: "MAC-IP and ethernet tag before their VTEP",
+			notifications: []*ndk.ConfigNotification{
+				configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, vrf, vniConfig),
+				configNotification(ndk.SdkMgrOperation_Create, macIpConfigPath, mac, `{"ip_address": [{"value": "10.0.0.1"}]}`),
+				configNotification(ndk.SdkMgrOperation_Create, ethernetTagConfigPath, tag, `{"vni": {"value": "100"}}`),
+				configNotification(ndk.SdkMgrOperation_Create, vtepConfigPath, vtep, vtepConfig),
+			},
+			staticMacs:   []string{"00:00:00:00:00:02"},
+			macIps:       map[string][]string{"00:00:00:00:00:01": {"10.0.0.1"}},
+			ethernetTags: []string{"100"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, agent, stdin := newTestConfigurationManager(t)
+			for _, n := range tt.notifications {
+				c.processNotification(agent, n)
+			}
+			if len(stdin.messages(t, "vrf")) != 0 {
+				t.Fatal("configs sent before commit.end")
+			}
+			c.processNotification(agent, commitEnd)
+
+			config := lastVrfMessage(t, stdin)["mac-vrf-1"]
+			if config == nil {
+				t.Fatal("mac-vrf not sent")
+			}
+			v, found := config.Vteps["1.1.1.1"]
+			if tt.staticMacs == nil {
+				if found {
+					t.Errorf("VTEP sent: %+v", v)
+				}
+				return
+			}
+			if !found {
+				t.Fatal("VTEP not sent")
+			}
+			if !reflect.DeepEqual(v.StaticMacs, tt.staticMacs) {
+				t.Errorf("static MACs = %v, want %v", v.StaticMacs, tt.staticMacs)
+			}
+			if len(v.MacIps) != 0 || len(tt.macIps) != 0 {
+				if !reflect.DeepEqual(v.MacIps, tt.macIps) {
+					t.Errorf("MAC-IPs = %v, want %v", v.MacIps, tt.macIps)
+				}
+			}
+			var tags []string
+			for id := range v.EthernetTags {
+				tags = append(tags, id)
+			}
+			sort.Strings(tags)
+			if !reflect.DeepEqual(tags, tt.ethernetTags) {
+				t.Errorf("ethernet tags = %v, want %v", tags, tt.ethernetTags)
+			}
+		})
+	}
+}
+
+func TestSendVrfConfigs(t *testing.T) {
+	c, agent, stdin := newTestConfigurationManager(t)
+	sent := func() map[string]*VniConfig {
+		defer stdin.Reset()
+		return lastVrfMessage(t, stdin)
+	}
+
+	c.sendVrfConfigs(agent, map[string]VniConfig{"mac-vrf-1": {Evi: "1"}, "mac-vrf-2": {Evi: "2"}})
+	if got := sent(); len(got) != 2 {
+		t.Errorf("first commit sent %v, want both mac-vrfs", got)
+	}
+
+	// Only the changed mac-vrf and the deleted one, as null
+	c.sendVrfConfigs(agent, map[string]VniConfig{"mac-vrf-1": {Evi: "10"}})
+	if got, want := sent(), map[string]*VniConfig{"mac-vrf-1": {Evi: "10"}, "mac-vrf-2": nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second commit sent %v, want %v", got, want)
+	}
+
+	// A commit without changes still sends an empty delta, the speaker reports its routes on each one
+	c.sendVrfConfigs(agent, map[string]VniConfig{"mac-vrf-1": {Evi: "10"}})
+	if got := sent(); len(got) != 0 {
+		t.Errorf("unchanged commit sent %v", got)
+	}
+
+	// Everything again to a restarted speaker
+	c.resetSent()
+	c.sendVrfConfigs(agent, map[string]VniConfig{"mac-vrf-1": {Evi: "10"}})
+	if got := sent(); got["mac-vrf-1"] == nil {
+		t.Errorf("commit after reset sent %v", got)
+	}
+}
+
+func TestResync(t *testing.T) {
+	c, agent, stdin := newTestConfigurationManager(t)
+	telemetry := agent.TelemetryServiceClient.(*testTelemetry)
+	vniConfig := `{"admin_state": "ADMIN_STATE_enable", "evi": {"value": "1"}, "vni": {"value": "10"}}`
+	for _, vrf := range []string{"mac-vrf-1", "mac-vrf-2"} {
+		c.processNotification(agent, configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, []string{vrf, "1"}, vniConfig))
+	}
+	c.processNotification(agent, commitEnd)
+	if _, found := agent.telemetry[operStatePath("mac-vrf-2", "1")]; !found {
+		t.Fatal("oper-state of mac-vrf-2 not published")
+	}
+	telemetry.deleted()
+	stdin.Reset()
+
+	// mac-vrf-2 was deleted while the NDK manager was down, the replay only has mac-vrf-1
+	c.resync()
+	c.processNotification(agent, configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, []string{"mac-vrf-1", "1"}, vniConfig))
+	if len(telemetry.deleted()) != 0 {
+		t.Fatal("state deleted before the commit.end of the replay")
+	}
+	c.processNotification(agent, commitEnd)
+
+	if got, want := telemetry.deleted(), [][]string{{operStatePath("mac-vrf-2", "1")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted %v, want %v", got, want)
+	}
+	if _, found := agent.telemetry[operStatePath("mac-vrf-1", "1")]; !found {
+		t.Error("oper-state of mac-vrf-1 not published again")
+	}
+	if got, want := lastVrfMessage(t, stdin), map[string]*VniConfig{"mac-vrf-2": nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay sent %v, want %v", got, want)
+	}
+}
+
+func TestEffectiveVniConfigs(t *testing.T) {
+	single := map[string]Vtep{"1.1.1.1": {}}
+
+	tests := []struct {
+		name   string
+		config VniConfig
+		// Oper-state of the network-instance and whether NDK reports it as an L3VRF
+		netInstUp *bool
+		ipVrf     *bool
+		// Type of the VRF sent to the speaker, "" when it is left out
+		want   string
+		state  string
+		reason string
+	}{
+		{
+			name:   "mac-vrf",
+			config: VniConfig{Evi: "1", Vni: "10", Vteps: single},
+			want:   "mac-vrf",
+			state:  "up",
+		},
+		{
+			name:   "ip-vrf from router-mac",
+			config: VniConfig{Evi: "1", Vni: "10", Vteps: map[string]Vtep{"1.1.1.1": {RouterMac: "00:00:00:00:00:01"}}},
+			want:   "ip-vrf",
+			state:  "up",
+		},
+		{
+			name:   "ip-vrf from NDK",
+			config: VniConfig{Evi: "1", Vni: "10", Vteps: single},
+			ipVrf:  boolPtr(true),
+			want:   "ip-vrf",
+			state:  "up",
+		},
+		{
+			name:      "network-instance down",
+			config:    VniConfig{Evi: "1", Vni: "10", Vteps: single},
+			netInstUp: boolPtr(false),
+			state:     "down",
+			reason:    "mac-vrf is operationally down",
+		},
+		{
+			name:   "EVI not resolved yet",
+			config: VniConfig{Vni: "10", Vteps: single},
+			state:  "down",
+			reason: "resolving EVI and VNI of the mac-vrf",
+		},
+		{
+			name:   "originator router-id with several VTEPs",
+			config: VniConfig{Evi: "1", Vni: "10", Originator: "ORIGINATOR_router_id", Vteps: map[string]Vtep{"1.1.1.1": {}, "1.1.1.2": {}}},
+			state:  "down",
+			reason: "originator router-id requires a single static-vtep",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, agent, _ := newTestConfigurationManager(t)
+			c.vniConfigs["vrf"] = tt.config
+			if tt.netInstUp != nil {
+				c.netInstUp["vrf"] = *tt.netInstUp
+			}
+			if tt.ipVrf != nil {
+				c.ipVrfs["vrf"] = *tt.ipVrf
+			}
+
+			configs := c.effectiveVniConfigs(agent)
+			if got := configs["vrf"].Type; got != tt.want {
+				t.Errorf("type = %q, want %q", got, tt.want)
+			}
+			// Published oper-states are kept as state and reason
+			if got, want := c.operStates["vrf"], tt.state+tt.reason; got != want {
+				t.Errorf("oper-state = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func BenchmarkConfigurationManager(b *testing.B) {
+	notifications := loadGenNotifications(100, 20, 4, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, agent, _ := newTestConfigurationManager(b)
+		for _, n := range notifications {
+			c.processNotification(agent, n)
+		}
+		c.processNotification(agent, commitEnd)
+	}
+}
+
+func BenchmarkConfigurationManagerCommit(b *testing.B) {
+	c, agent, stdin := newTestConfigurationManager(b)
+	for _, n := range loadGenNotifications(100, 20, 4, 0) {
+		c.processNotification(agent, n)
+	}
+	changes := loadGenNotifications(100, 20, 4, 1)[:100]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stdin.Reset()
+		for _, n := range changes {
+			c.processNotification(agent, n)
+		}
+		c.processNotification(agent, commitEnd)
+	}
+}
@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/nokia/srlinux-ndk-go v0.1.0
 	github.com/osrg/gobgp/v3 v3.0.0-rc2
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/zerolog v1.26.0
 	github.com/vishvananda/netns v0.0.0-20200728191858-db3c7e526aae
 	google.golang.org/grpc v1.43.0
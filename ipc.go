@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// The agent and the BGP Speaker exchange JSON messages, one per line. The largest ones are the rib reports, which grow
+// with the routes of all mac-vrfs, far beyond the 64 KiB that a bufio.Scanner accepts by default
+const maxMessageSize = 64 * 1024 * 1024
+
+var errMessageTooLong = errors.New("message too long")
+
+// messageReader reads the messages of a pipe. Unlike a bufio.Scanner it skips a message longer than its limit and
+// carries on with the next one, so the writer never blocks on a reader that gave up
+type messageReader struct {
+	r       *bufio.Reader
+	maxSize int
+	line    []byte
+}
+
+func newMessageReader(r io.Reader, maxSize int) *messageReader {
+	return &messageReader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// Next returns the next message, which is valid until the following call. It returns errMessageTooLong for a
+// skipped message, and io.EOF once the pipe is closed
+func (m *messageReader) Next() ([]byte, error) {
+	m.line = m.line[:0]
+	tooLong := false
+	for {
+		chunk, err := m.r.ReadSlice('\n')
+		if !tooLong && len(m.line)+len(bytes.TrimSuffix(chunk, []byte("\n"))) > m.maxSize {
+			tooLong = true
+			m.line = m.line[:0]
+		}
+		if !tooLong {
+			m.line = append(m.line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLong {
+			return nil, errMessageTooLong
+		}
+		if err != nil && (err != io.EOF || len(m.line) == 0) {
+			return nil, err
+		}
+		return bytes.TrimSuffix(m.line, []byte("\n")), nil
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMessageReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// Messages read, "!" for a skipped one
+		want []string
+	}{
+		{name: "messages", input: "{\"key\": \"a\"}\n{\"key\": \"b\"}\n", want: []string{`{"key": "a"}`, `{"key": "b"}`}},
+		{name: "without final newline", input: "a\nb", want: []string{"a", "b"}},
+		{name: "at the limit", input: strings.Repeat("a", 16) + "\nb\n", want: []string{strings.Repeat("a", 16), "b"}},
+		{name: "too long", input: "a\n" + strings.Repeat("b", 17) + "\nc\n", want: []string{"a", "!", "c"}},
+		{name: "too long at the end", input: "a\n" + strings.Repeat("b", 100), want: []string{"a", "!"}},
+		{name: "empty", input: "", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newMessageReader(nil, 16)
+			// The smallest buffer, so that messages span several reads
+			r.r = bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+			var got []string
+			for {
+				msg, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err == errMessageTooLong {
+					got = append(got, "!")
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				got = append(got, string(msg))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
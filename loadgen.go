@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+)
+
+// LoadGenReport is the outcome of a load generator run, printed as JSON on stdout
+type LoadGenReport struct {
+	Vrfs          int `json:"vrfs"`
+	VtepsPerVrf   int `json:"vteps_per_vrf"`
+	MacsPerVtep   int `json:"macs_per_vtep"`
+	Notifications int `json:"notifications"`
+
+	// Processing all config notifications by the ConfigurationManager
+	ConfigDuration        time.Duration `json:"config_duration_ns"`
+	ConfigPerNotification time.Duration `json:"config_per_notification_ns"`
+
+	// Commit to advertise: commit.end of the ConfigurationManager, IPC of the VRF configs and ProcessRoutes until
+	// the paths are in the RIB
+	InitialCommit   time.Duration   `json:"initial_commit_ns"`
+	Commits         []time.Duration `json:"commits_ns"`
+	CommitP50       time.Duration   `json:"commit_p50_ns"`
+	CommitMax       time.Duration   `json:"commit_max_ns"`
+	RibPaths        int             `json:"rib_paths"`
+	PathsAdvertised int             `json:"paths_advertised"`
+	PathsWithdrawn  int             `json:"paths_withdrawn"`
+	HeapAllocBytes  uint64          `json:"heap_alloc_bytes"`
+	TotalAllocBytes uint64          `json:"total_alloc_bytes"`
+	CommitBudgetHit bool            `json:"commit_budget_exceeded"`
+}
+
+// runLoadGen synthesizes the config notifications of a large number of mac-vrfs and static VTEPs, feeds them through
+// the ConfigurationManager and a local BGP speaker without peer, and reports latency, memory and RIB operations.
+// It returns the exit code, 1 when a commit exceeds the -max-commit budget so it can gate regressions
+func runLoadGen(ctx context.Context, logger *zerolog.Logger, args []string) int {
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	vrfs := flags.Int("vrfs", 1000, "number of mac-vrfs")
+	vteps := flags.Int("vteps", 20, "static VTEPs per mac-vrf")
+	macs := flags.Int("macs", 4, "static MACs per VTEP")
+	commits := flags.Int("commits", 10, "incremental commits after the initial one")
+	churn := flags.Int("churn", 1, "percentage of the VTEPs changed by each incremental commit")
+	maxCommit := flags.Duration("max-commit", 0, "fail when a commit takes longer, 0 for no budget")
+	verbose := flags.Bool("v", false, "keep info logging of the agent and speaker")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if !*verbose {
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	}
+
+	// The applied state of a load generator run must not warm-start a real agent
+	os.Setenv("STATIC_VXLAN_AGENT_STATE_FILE", "")
+
+	// The agent and the speaker talk over pipes, with the IPC framing and the reader loops of the real processes
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	speaker := NewBGPSpeaker(logger)
+	speaker.out = stdoutWriter
+	speaker.LocalAS, speaker.PeerAS = 65000, 65000
+	speaker.RouterId, speaker.Neighbour = "127.0.0.1", "127.0.0.2"
+	speaker.Start()
+	defer func() {
+		speaker.lock.Lock()
+		speaker.Stop()
+		speaker.lock.Unlock()
+	}()
+
+	go speaker.readMessages(stdinReader)
+	defer stdinWriter.Close()
+	routes := loadGenRoutes(stdoutReader)
+
+	report := &LoadGenReport{Vrfs: *vrfs, VtepsPerVrf: *vteps, MacsPerVtep: *macs}
+	agent := &Agent{
+		metrics:                NewMetrics(logger),
+		logger:                 logger,
+		telemetryCtx:           context.Background(),
+		telemetry:              make(map[string]string),
+		TelemetryServiceClient: loadGenTelemetry{},
+		ChildStdin:             stdinWriter,
+	}
+	c := NewConfigurationManager(logger)
+
+	notifications := loadGenNotifications(*vrfs, *vteps, *macs, 0)
+	report.Notifications = len(notifications)
+	start := time.Now()
+	for _, n := range notifications {
+		c.processNotification(agent, n)
+	}
+	report.ConfigDuration = time.Since(start)
+	if len(notifications) > 0 {
+		report.ConfigPerNotification = report.ConfigDuration / time.Duration(len(notifications))
+	}
+
+	// A commit ends once the speaker reports the routes it programmed for the configs sent on commit.end
+	commitEnd := &ndk.ConfigNotification{Op: ndk.SdkMgrOperation_Create, Key: &ndk.ConfigKey{JsPath: ".commit.end"}}
+	commit := func() time.Duration {
+		start := time.Now()
+		c.processNotification(agent, commitEnd)
+		stats := <-routes
+		elapsed := time.Since(start)
+
+		for _, r := range stats {
+			report.PathsAdvertised += r.Advertised
+			report.PathsWithdrawn += r.Withdrawn
+		}
+		if *maxCommit > 0 && elapsed > *maxCommit {
+			report.CommitBudgetHit = true
+		}
+		return elapsed
+	}
+	report.InitialCommit = commit()
+
+	changed := *vrfs * *vteps * *churn / 100
+	if changed == 0 {
+		changed = 1
+	} else if changed > *vrfs**vteps {
+		changed = *vrfs * *vteps
+	}
+	for i := 1; i <= *commits && ctx.Err() == nil; i++ {
+		// Replace a static MAC of each changed VTEP, i.e. a withdrawal and an advertisement
+		for _, n := range loadGenNotifications(*vrfs, *vteps, *macs, i)[:changed] {
+			c.processNotification(agent, n)
+		}
+		report.Commits = append(report.Commits, commit())
+	}
+
+	if len(report.Commits) > 0 {
+		sorted := append([]time.Duration{}, report.Commits...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		report.CommitP50 = sorted[len(sorted)/2]
+		report.CommitMax = sorted[len(sorted)-1]
+	}
+	speaker.lock.Lock()
+	report.RibPaths = len(speaker.GetRib())
+	speaker.lock.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	report.HeapAllocBytes = mem.HeapAlloc
+	report.TotalAllocBytes = mem.TotalAlloc
+
+	str, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(str))
+	if report.CommitBudgetHit {
+		return 1
+	}
+	return 0
+}
+
+// loadGenTelemetry stands in for the NDK telemetry service, which the load generator runs without
+type loadGenTelemetry struct {
+	ndk.SdkMgrTelemetryServiceClient
+}
+
+func (loadGenTelemetry) TelemetryAddOrUpdate(ctx context.Context, in *ndk.TelemetryUpdateRequest, opts ...grpc.CallOption) (*ndk.TelemetryUpdateResponse, error) {
+	return &ndk.TelemetryUpdateResponse{Status: ndk.SdkMgrStatus_kSdkMgrSuccess}, nil
+}
+
+func (loadGenTelemetry) TelemetryDelete(ctx context.Context, in *ndk.TelemetryDeleteRequest, opts ...grpc.CallOption) (*ndk.TelemetryDeleteResponse, error) {
+	return &ndk.TelemetryDeleteResponse{Status: ndk.SdkMgrStatus_kSdkMgrSuccess}, nil
+}
+
+// loadGenRoutes reads the reports of the speaker as the agent does, and returns the route counts of each commit
+func loadGenRoutes(stdout io.Reader) <-chan map[string]*RouteReport {
+	routes := make(chan map[string]*RouteReport, 1)
+	go func() {
+		reader := newMessageReader(stdout, maxMessageSize)
+		for {
+			line, err := reader.Next()
+			if err == errMessageTooLong {
+				continue
+			} else if err != nil {
+				return
+			}
+			var msg struct {
+				Key  string                  `json:"key"`
+				Data map[string]*RouteReport `json:"data"`
+			}
+			if json.Unmarshal(line, &msg) == nil && msg.Key == "routes" {
+				routes <- msg.Data
+			}
+		}
+	}()
+	return routes
+}
+
+// loadGenNotifications returns the notifications of the mac-vrfs followed by the ones of their VTEPs, in the order
+// NDK replays them. Generation shifts the static MACs, changed VTEPs come first
+func loadGenNotifications(vrfs int, vteps int, macs int, generation int) []*ndk.ConfigNotification {
+	notification := func(path string, keys []string, data interface{}) *ndk.ConfigNotification {
+		str, _ := json.Marshal(data)
+		return &ndk.ConfigNotification{
+			Op:   ndk.SdkMgrOperation_Change,
+			Key:  &ndk.ConfigKey{JsPath: path, Keys: keys},
+			Data: &ndk.ConfigData{Json: string(str)},
+		}
+	}
+	value := func(v string) map[string]string { return map[string]string{"value": v} }
+
+	var vrfNotifications, vtepNotifications []*ndk.ConfigNotification
+	for v := 0; v < vrfs; v++ {
+		vrf := fmt.Sprintf("mac-vrf-%d", v)
+		vrfNotifications = append(vrfNotifications, notification(
+			".network_instance.protocols.bgp_evpn.bgp_instance.static_vxlan_agent", []string{vrf, "1"},
+			map[string]interface{}{
+				"admin_state": "ADMIN_STATE_enable",
+				"evi":         value(fmt.Sprint(v + 1)),
+				"vni":         value(fmt.Sprint(v + 1)),
+			}))
+	}
+	for t := 0; t < vteps; t++ {
+		for v := 0; v < vrfs; v++ {
+			vtep := fmt.Sprintf("10.%d.%d.%d", t/256, t%256, 1+v%250)
+			var staticMacs []map[string]string
+			for m := 0; m < macs; m++ {
+				staticMacs = append(staticMacs, value(fmt.Sprintf("00:%02x:%02x:%02x:%02x:%02x", v>>8&0xff, v&0xff, t&0xff, m&0xff, (generation+m)&0xff)))
+			}
+			vtepNotifications = append(vtepNotifications, notification(
+				".network_instance.protocols.bgp_evpn.bgp_instance.static_vxlan_agent.static_vtep",
+				[]string{fmt.Sprintf("mac-vrf-%d", v), "1", vtep},
+				map[string]interface{}{"static_macs": staticMacs}))
+		}
+	}
+	if generation > 0 {
+		return vtepNotifications
+	}
+	return append(vrfNotifications, vtepNotifications...)
+}
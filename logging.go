@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/osrg/gobgp/v3/pkg/log"
+	"github.com/rs/zerolog"
+)
+
+type TraceOptions struct {
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+}
+
+// logOutput writes log lines either as raw JSON or through a ConsoleWriter,
+// so the format can be switched at runtime without replacing the shared logger
+type logOutput struct {
+	mu      sync.Mutex
+	json    bool
+	out     io.Writer
+	console zerolog.ConsoleWriter
+}
+
+var logOut = &logOutput{
+	out: os.Stderr,
+	console: zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: logTimeFormat,
+		NoColor:    true,
+	},
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.json {
+		return o.out.Write(p)
+	}
+	return o.console.Write(p)
+}
+
+func newLogger() zerolog.Logger {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	return zerolog.New(logOut).With().Timestamp().Logger()
+}
+
+// applyTraceOptions changes the level and format of all loggers of this process
+func applyTraceOptions(logger *zerolog.Logger, t *TraceOptions) {
+	level := zerolog.InfoLevel
+	if t.LogLevel != "" {
+		l, err := zerolog.ParseLevel(strings.TrimPrefix(t.LogLevel, "LOG_LEVEL_"))
+		if err != nil {
+			logger.Warn().Str("log-level", t.LogLevel).Msg("Unknown log level, using info")
+		} else {
+			level = l
+		}
+	}
+
+	logOut.mu.Lock()
+	logOut.json = strings.TrimPrefix(t.LogFormat, "LOG_FORMAT_") == "json"
+	logOut.mu.Unlock()
+
+	zerolog.SetGlobalLevel(level)
+	logger.Info().Str("log-level", level.String()).Str("log-format", t.LogFormat).Msg("Applied trace options")
+}
+
+// implement github.com/osrg/gobgp/v3/pkg/log/Logger interface
+type appLogger struct {
+	logger *zerolog.Logger
+}
+
+func (l *appLogger) Panic(msg string, fields log.Fields) {
+	l.logger.Panic().Fields(map[string]interface{}(fields)).Msg(msg)
+}
+
+func (l *appLogger) Fatal(msg string, fields log.Fields) {
+	l.logger.Fatal().Fields(map[string]interface{}(fields)).Msg(msg)
+}
+
+func (l *appLogger) Error(msg string, fields log.Fields) {
+	l.logger.Error().Fields(map[string]interface{}(fields)).Msg(msg)
+}
+
+func (l *appLogger) Warn(msg string, fields log.Fields) {
+	l.logger.Warn().Fields(map[string]interface{}(fields)).Msg(msg)
+}
+
+func (l *appLogger) Info(msg string, fields log.Fields) {
+	l.logger.Info().Fields(map[string]interface{}(fields)).Msg(msg)
+}
+
+func (l *appLogger) Debug(msg string, fields log.Fields) {
+	l.logger.Debug().Fields(map[string]interface{}(fields)).Msg(msg)
+}
+
+func (l *appLogger) SetLevel(level log.LogLevel) {
+	zerolog.SetGlobalLevel(zerolog.PanicLevel - zerolog.Level(level))
+}
+
+func (l *appLogger) GetLevel() log.LogLevel {
+	level := zerolog.GlobalLevel()
+	if l.logger.GetLevel() > level {
+		level = l.logger.GetLevel()
+	}
+	if level < zerolog.TraceLevel {
+		level = zerolog.TraceLevel
+	} else if level > zerolog.PanicLevel {
+		level = zerolog.PanicLevel
+	}
+	return log.LogLevel(zerolog.PanicLevel - level)
+}
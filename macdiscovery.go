@@ -0,0 +1,210 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// MacDiscoveryConfig enables learning the MACs of static VTEPs from the bridge table of a mac-vrf
+type MacDiscoveryConfig struct {
+	AdminState   string `json:"admin_state"`
+	PollInterval uint32 `json:"poll_interval"`
+}
+
+// defaultPollInterval applies when a mac-vrf has no poll-interval
+const defaultPollInterval = 10 * time.Second
+
+// MacDiscovery polls the bridge tables for MACs learned behind static VTEPs.
+// NDK has no bridge table notifications, so the learnt entries are read from the state with sr_cli. A single read
+// covers the mac-vrfs of all static VTEPs. Only data plane learnt entries are read: the MACs advertised by the agent
+// itself get installed as evpn entries of the mac-table, but remain advertised until they age out of the learnt entries
+type MacDiscovery struct {
+	logger *zerolog.Logger
+
+	// Signals a mac-vrf whose learned MACs changed
+	Events chan string
+
+	mu sync.Mutex
+	// Mac-vrfs that enable MAC discovery
+	configs map[string]MacDiscoveryConfig
+	// Learned MACs by VTEP by mac-vrf
+	macs    map[string]map[string][]string
+	running bool
+	refresh chan struct{}
+}
+
+func NewMacDiscovery(logger *zerolog.Logger) *MacDiscovery {
+	return &MacDiscovery{
+		logger:  logger,
+		Events:  make(chan string, 16),
+		configs: make(map[string]MacDiscoveryConfig),
+		macs:    make(map[string]map[string][]string),
+		refresh: make(chan struct{}, 1),
+	}
+}
+
+func (c *MacDiscoveryConfig) enabled() bool {
+	return c.AdminState == "ADMIN_STATE_enable"
+}
+
+func (c *MacDiscoveryConfig) interval() time.Duration {
+	if c.PollInterval == 0 {
+		return defaultPollInterval
+	}
+	return time.Duration(c.PollInterval) * time.Second
+}
+
+// Sync sets the mac-vrfs to poll, the ones that weren't polled yet are read right away
+func (d *MacDiscovery) Sync(configs map[string]MacDiscoveryConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	enabled := make(map[string]MacDiscoveryConfig)
+	added := false
+	for vrf, config := range configs {
+		if !config.enabled() {
+			continue
+		}
+		enabled[vrf] = config
+		if _, found := d.configs[vrf]; !found {
+			added = true
+		}
+	}
+	for vrf := range d.macs {
+		if _, found := enabled[vrf]; !found {
+			delete(d.macs, vrf)
+		}
+	}
+	d.configs = enabled
+
+	if len(enabled) > 0 && !d.running {
+		d.running = true
+		go d.run()
+	}
+	if added {
+		select {
+		case d.refresh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Macs returns the MACs learned behind a VTEP in a mac-vrf
+func (d *MacDiscovery) Macs(vrf string, vtep string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.macs[vrf][vtep]
+}
+
+// run reads the bridge tables at the shortest poll-interval of the mac-vrfs
+func (d *MacDiscovery) run() {
+	for {
+		d.mu.Lock()
+		configs := d.configs
+		d.mu.Unlock()
+
+		interval := time.Duration(0)
+		for _, config := range configs {
+			if interval == 0 || config.interval() < interval {
+				interval = config.interval()
+			}
+		}
+		if interval == 0 {
+			interval = defaultPollInterval
+		}
+		if len(configs) > 0 {
+			d.poll(configs)
+		}
+
+		select {
+		case <-d.refresh:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (d *MacDiscovery) poll(configs map[string]MacDiscoveryConfig) {
+	learned, err := learnedMacs()
+	if err != nil {
+		d.logger.Warn().Err(err).Msg("Can't read bridge tables")
+		return
+	}
+
+	var changed []string
+	d.mu.Lock()
+	for vrf := range configs {
+		if _, found := d.configs[vrf]; !found {
+			// Disabled meanwhile
+			continue
+		}
+		// Aged out MACs are no longer learnt, so they get withdrawn
+		if sameMacs(learned[vrf], d.macs[vrf]) {
+			continue
+		}
+		d.macs[vrf] = learned[vrf]
+		changed = append(changed, vrf)
+	}
+	d.mu.Unlock()
+
+	sort.Strings(changed)
+	for _, vrf := range changed {
+		d.logger.Info().Str("vrf", vrf).Interface("macs", learned[vrf]).Msg("Learned MACs of static VTEPs changed")
+		d.Events <- vrf
+	}
+}
+
+// sameMacs compares learned MACs by VTEP, no MACs at all being the same whether the map is nil or empty
+func sameMacs(a map[string][]string, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for vtep, macs := range a {
+		if !reflect.DeepEqual(macs, b[vtep]) {
+			return false
+		}
+	}
+	return true
+}
+
+// learnedMacs reads the learnt entries of all mac-vrfs
+func learnedMacs() (map[string]map[string][]string, error) {
+	state, err := srCliState("network-instance * bridge-table mac-learning learnt-entries")
+	if err != nil {
+		return nil, err
+	}
+	return learnedState(state), nil
+}
+
+// learnedState groups the learnt MACs with a vxlan destination by mac-vrf and VTEP
+func learnedState(state interface{}) map[string]map[string][]string {
+	learned := make(map[string]map[string][]string)
+	for _, ni := range jsonList(state, "network-instance") {
+		vrf, _ := jsonLeaf(ni, "name")
+		macs := make(map[string][]string)
+		for _, entry := range jsonList(ni, "bridge-table", "mac-learning", "learnt-entries", "mac") {
+			address, _ := jsonLeaf(entry, "address")
+			destination, _ := jsonLeaf(entry, "destination")
+			if address == "" {
+				continue
+			}
+			// e.g. vxlan-interface:vxlan1.210 vtep:1.1.1.4 vni:210
+			for _, field := range strings.Fields(destination) {
+				if vtep := strings.TrimPrefix(field, "vtep:"); vtep != field {
+					macs[vtep] = append(macs[vtep], address)
+				}
+			}
+		}
+		for _, m := range macs {
+			sort.Strings(m)
+		}
+		if len(macs) > 0 {
+			learned[vrf] = macs
+		}
+	}
+	return learned
+}
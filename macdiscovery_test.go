@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// As sr_cli reports the learnt entries, with module prefixes where the YANG module changes
+const testLearntState = `{
+  "srl_nokia-network-instance:network-instance": [
+    {
+      "name": "mac-vrf-1",
+      "srl_nokia-bridge-table:bridge-table": {
+        "srl_nokia-bridge-table-mac-learning:mac-learning": {
+          "learnt-entries": {
+            "mac": [
+              {"address": "00:00:00:00:00:02", "destination": "vxlan-interface:vxlan1.10 vtep:1.1.1.1 vni:10"},
+              {"address": "00:00:00:00:00:01", "destination": "vxlan-interface:vxlan1.10 vtep:1.1.1.1 vni:10"},
+              {"address": "00:00:00:00:00:03", "destination": "vxlan-interface:vxlan1.10 vtep:2.2.2.2 vni:10"},
+              {"address": "00:00:00:00:00:04", "destination": "ethernet-1/1.0"}
+            ]
+          }
+        }
+      }
+    },
+    {
+      "name": "mac-vrf-2",
+      "srl_nokia-bridge-table:bridge-table": {
+        "srl_nokia-bridge-table-mac-learning:mac-learning": {
+          "learnt-entries": {
+            "mac": [{"address": "00:00:00:00:00:05", "destination": "ethernet-1/2.0"}]
+          }
+        }
+      }
+    }
+  ]
+}`
+
+func TestLearnedState(t *testing.T) {
+	var state interface{}
+	if err := json.Unmarshal([]byte(testLearntState), &state); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string][]string{
+		"mac-vrf-1": {
+			"1.1.1.1": {"00:00:00:00:00:01", "00:00:00:00:00:02"},
+			"2.2.2.2": {"00:00:00:00:00:03"},
+		},
+	}
+	if got := learnedState(state); !reflect.DeepEqual(got, want) {
+		t.Errorf("learnedState() = %v, want %v", got, want)
+	}
+}
+
+func TestMacDiscoverySync(t *testing.T) {
+	logger := zerolog.Nop()
+	d := NewMacDiscovery(&logger)
+	// Not reading the state
+	d.running = true
+
+	enabled := MacDiscoveryConfig{AdminState: "ADMIN_STATE_enable"}
+	d.Sync(map[string]MacDiscoveryConfig{"mac-vrf-1": enabled, "mac-vrf-2": enabled})
+	d.macs["mac-vrf-1"] = map[string][]string{"1.1.1.1": {"00:00:00:00:00:01"}}
+	d.macs["mac-vrf-2"] = map[string][]string{"1.1.1.1": {"00:00:00:00:00:02"}}
+	// Drain the read of the added mac-vrfs
+	<-d.refresh
+
+	d.Sync(map[string]MacDiscoveryConfig{"mac-vrf-1": enabled, "mac-vrf-2": {AdminState: "ADMIN_STATE_disable"}})
+	if got := d.Macs("mac-vrf-1", "1.1.1.1"); !reflect.DeepEqual(got, []string{"00:00:00:00:00:01"}) {
+		t.Errorf("Macs() of an enabled mac-vrf = %v", got)
+	}
+	if got := d.Macs("mac-vrf-2", "1.1.1.1"); got != nil {
+		t.Errorf("Macs() of a disabled mac-vrf = %v, want none", got)
+	}
+	select {
+	case <-d.refresh:
+		t.Errorf("Sync() read the state again without any added mac-vrf")
+	default:
+	}
+}
+
+func TestSameMacs(t *testing.T) {
+	tests := []struct {
+		a, b map[string][]string
+		want bool
+	}{
+		{a: nil, b: map[string][]string{}, want: true},
+		{a: map[string][]string{"1.1.1.1": {"00:00:00:00:00:01"}}, b: map[string][]string{"1.1.1.1": {"00:00:00:00:00:01"}}, want: true},
+		{a: map[string][]string{"1.1.1.1": {"00:00:00:00:00:01"}}, b: map[string][]string{"2.2.2.2": {"00:00:00:00:00:01"}}, want: false},
+		{a: map[string][]string{"1.1.1.1": {"00:00:00:00:00:01"}}, b: nil, want: false},
+	}
+	for i, tt := range tests {
+		if got := sameMacs(tt.a, tt.b); got != tt.want {
+			t.Errorf("%d: sameMacs(%v, %v) = %v, want %v", i, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
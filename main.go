@@ -27,6 +27,9 @@ const (
 
 func runAgent(ctx context.Context, logger *zerolog.Logger) {
 	agent := newAgent(ctx, appName, logger)
+	if agent == nil {
+		os.Exit(1)
+	}
     agent.Run(ctx)
 }
 
@@ -44,15 +47,13 @@ func main() {
 	// If the parent bash script gets killed, we don't wanna be orphaned. We wanna threat this as a SIGTERM
 	syscall.RawSyscall(uintptr(157), uintptr(1), uintptr(syscall.SIGTERM), 0)
 
-	// set logger parameters
-	logger := zerolog.New(zerolog.ConsoleWriter{
-		Out:        os.Stderr,
-		TimeFormat: logTimeFormat,
-		NoColor:    true,
-	}).With().Timestamp().Logger()
+	// set logger parameters, level and format can later be changed through trace-options
+	logger := newLogger()
 
 	if len(os.Args) > 1 && os.Args[1] == "-c" {
 		runBgpServer(ctx, &logger)
+	} else if len(os.Args) > 1 && os.Args[1] == "-loadgen" {
+		os.Exit(runLoadGen(ctx, &logger, os.Args[2:]))
 	} else {
 		runAgent(ctx, &logger)
 	}
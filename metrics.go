@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/vishvananda/netns"
+)
+
+type MetricsConfig struct {
+	AdminState      string `json:"admin_state"`
+	NetworkInstance struct {
+		Value string `json:"value"`
+	} `json:"network_instance"`
+	Port struct {
+		Value string `json:"value"`
+	} `json:"port"`
+}
+
+type PeerStateReport struct {
+	Neighbor string `json:"neighbor"`
+	State    string `json:"state"`
+	Value    int32  `json:"value"`
+}
+
+type RouteReport struct {
+	Advertised int `json:"advertised"`
+	Withdrawn  int `json:"withdrawn"`
+}
+
+// Metrics holds the Prometheus collectors of the agent. Counters of the BGP speaker
+// are reported to the agent over IPC and exposed from here, so there is a single endpoint
+type Metrics struct {
+	registry *prometheus.Registry
+	logger   *zerolog.Logger
+
+	sessionState        *prometheus.GaugeVec
+	peerFlaps           *prometheus.CounterVec
+	routesAdvertised    *prometheus.CounterVec
+	routesWithdrawn     *prometheus.CounterVec
+	configNotifications *prometheus.CounterVec
+	ipcMessages         *prometheus.CounterVec
+	ipcErrors           *prometheus.CounterVec
+	childRestarts       prometheus.Counter
+	ndkRegistrations    prometheus.Counter
+	notifications       *prometheus.CounterVec
+	queueDepth          prometheus.Gauge
+	queueFull           prometheus.Counter
+	queueWait           prometheus.Counter
+
+	mu         sync.Mutex
+	peerStates map[string]string
+	config     MetricsConfig
+	server     *http.Server
+}
+
+func NewMetrics(logger *zerolog.Logger) *Metrics {
+	m := &Metrics{
+		registry:   prometheus.NewRegistry(),
+		logger:     logger,
+		peerStates: make(map[string]string),
+	}
+
+	m.sessionState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "static_vxlan_agent_bgp_session_state",
+		Help: "BGP session state of the speaker (1=idle, 2=connect, 3=active, 4=opensent, 5=openconfirm, 6=established)",
+	}, []string{"neighbor"})
+	m.peerFlaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_bgp_peer_flaps_total",
+		Help: "Number of times the BGP session went down after being established",
+	}, []string{"neighbor"})
+	m.routesAdvertised = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_routes_advertised_total",
+		Help: "Number of EVPN routes advertised by the speaker",
+	}, []string{"mac_vrf"})
+	m.routesWithdrawn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_routes_withdrawn_total",
+		Help: "Number of EVPN routes withdrawn by the speaker",
+	}, []string{"mac_vrf"})
+	m.configNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_config_notifications_total",
+		Help: "Number of NDK config notifications processed",
+	}, []string{"path"})
+	m.ipcMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_ipc_messages_total",
+		Help: "Number of messages exchanged between the agent and the BGP speaker",
+	}, []string{"direction", "key"})
+	m.ipcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_ipc_errors_total",
+		Help: "Number of errors sending or decoding messages between the agent and the BGP speaker",
+	}, []string{"direction"})
+	m.childRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_child_restarts_total",
+		Help: "Number of times the BGP speaker process was (re)started",
+	})
+	m.ndkRegistrations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_ndk_registrations_total",
+		Help: "Number of times the agent (re)registered with the NDK manager",
+	})
+	m.notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_notifications_total",
+		Help: "Number of NDK notifications and agent events dispatched, by type",
+	}, []string{"type"})
+	m.queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "static_vxlan_agent_notification_queue_depth",
+		Help: "Number of notification stream responses waiting for the dispatcher",
+	})
+	m.queueFull = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_notification_queue_full_total",
+		Help: "Number of times the notification receiver waited because the queue was full",
+	})
+	m.queueWait = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "static_vxlan_agent_notification_queue_wait_seconds_total",
+		Help: "Time the notification receiver waited for the dispatcher",
+	})
+
+	m.registry.MustRegister(m.sessionState, m.peerFlaps, m.routesAdvertised, m.routesWithdrawn,
+		m.configNotifications, m.ipcMessages, m.ipcErrors, m.childRestarts, m.ndkRegistrations,
+		m.notifications, m.queueDepth, m.queueFull, m.queueWait)
+
+	return m
+}
+
+func (m *Metrics) ConfigNotification(path string) {
+	m.configNotifications.WithLabelValues(path).Inc()
+}
+
+func (m *Metrics) IpcMessage(direction string, key string) {
+	m.ipcMessages.WithLabelValues(direction, key).Inc()
+}
+
+func (m *Metrics) IpcError(direction string) {
+	m.ipcErrors.WithLabelValues(direction).Inc()
+}
+
+func (m *Metrics) ChildRestart() {
+	m.childRestarts.Inc()
+}
+
+func (m *Metrics) NdkRegistration() {
+	m.ndkRegistrations.Inc()
+}
+
+func (m *Metrics) Notification(kind string) {
+	m.notifications.WithLabelValues(kind).Inc()
+}
+
+func (m *Metrics) NotificationQueueDepth(depth int) {
+	m.queueDepth.Set(float64(depth))
+}
+
+func (m *Metrics) NotificationQueueFull(wait time.Duration) {
+	m.queueFull.Inc()
+	m.queueWait.Add(wait.Seconds())
+}
+
+func (m *Metrics) PeerState(r *PeerStateReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.peerStates[r.Neighbor] == "ESTABLISHED" && r.State != "ESTABLISHED" {
+		m.peerFlaps.WithLabelValues(r.Neighbor).Inc()
+	}
+	m.peerStates[r.Neighbor] = r.State
+	m.sessionState.WithLabelValues(r.Neighbor).Set(float64(r.Value))
+}
+
+func (m *Metrics) Routes(reports map[string]RouteReport) {
+	for vrf, r := range reports {
+		m.routesAdvertised.WithLabelValues(vrf).Add(float64(r.Advertised))
+		m.routesWithdrawn.WithLabelValues(vrf).Add(float64(r.Withdrawn))
+	}
+}
+
+// Configure starts, restarts or stops the /metrics endpoint according to the agent config
+func (m *Metrics) Configure(ctx context.Context, config MetricsConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if config == m.config {
+		return
+	}
+	m.config = config
+
+	if m.server != nil {
+		m.server.Shutdown(ctx)
+		m.server = nil
+	}
+
+	if config.AdminState != "ADMIN_STATE_enable" {
+		m.logger.Info().Msg("Metrics endpoint disabled")
+		return
+	}
+
+	addr := fmt.Sprintf(":%s", config.Port.Value)
+	l, err := listenInNetworkInstance(config.NetworkInstance.Value, addr)
+	if err != nil {
+		m.logger.Error().Err(err).Str("address", addr).Str("network-instance", config.NetworkInstance.Value).Msg("Can't listen for metrics")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: mux}
+
+	m.logger.Info().Str("address", addr).Str("network-instance", config.NetworkInstance.Value).Msg("Serving metrics")
+	go func(s *http.Server) {
+		if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
+			m.logger.Error().Err(err).Msg("Metrics endpoint failed")
+		}
+	}(m.server)
+}
+
+func (m *Metrics) Stop(ctx context.Context) {
+	m.Configure(ctx, MetricsConfig{})
+}
+
+// listenInNetworkInstance opens a TCP listener in the srbase-<name> namespace of a network-instance.
+// The socket stays in that namespace after the thread switches back. The switch happens on a goroutine of its own:
+// when the thread can't be switched back it stays locked, and Go terminates it together with the goroutine
+func listenInNetworkInstance(name string, addr string) (net.Listener, error) {
+	type result struct {
+		listener net.Listener
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		listener, restored, err := listenInNamespace("srbase-"+name, addr)
+		if restored {
+			runtime.UnlockOSThread()
+		}
+		done <- result{listener, err}
+	}()
+	r := <-done
+	return r.listener, r.err
+}
+
+// listenInNamespace switches the locked thread to a namespace, listens and switches back.
+// restored is false when the thread may be left in another namespace
+func listenInNamespace(namespace string, addr string) (listener net.Listener, restored bool, err error) {
+	origin, err := netns.Get()
+	if err != nil {
+		return nil, true, err
+	}
+	defer origin.Close()
+
+	ns, err := netns.GetFromName(namespace)
+	if err != nil {
+		return nil, true, err
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		// setns either fails or switches, but don't bet the thread on it
+		return nil, false, err
+	}
+	listener, err = net.Listen("tcp", addr)
+	if restoreErr := netns.Set(origin); restoreErr != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, false, fmt.Errorf("can't switch back from namespace %s: %v", namespace, restoreErr)
+	}
+	return listener, true, err
+}
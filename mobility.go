@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// DuplicateMac is a static MAC of a VTEP that the fabric also advertises from another next-hop
+type DuplicateMac struct {
+	Vrf         string `json:"-"`
+	BgpInstance string `json:"-"`
+
+	MacAddress       string `json:"mac_address"`
+	Vtep             string `json:"vtep"`
+	CompetingNextHop string `json:"competing_next_hop"`
+	CompetingRd      string `json:"competing_route_distinguisher"`
+	CompetingBest    bool   `json:"competing_best_route"`
+}
+
+// duplicateMacReport is the IPC encoding of a DuplicateMac, which also names its mac-vrf
+type duplicateMacReport struct {
+	Vrf         string `json:"vrf"`
+	BgpInstance string `json:"bgp_instance"`
+	*DuplicateMac
+}
+
+// findDuplicateMacs matches the received MAC/IP routes of each mac-vrf with the originated ones
+func (b *BGPSpeaker) findDuplicateMacs(rib map[string][]*RibRoute) []*DuplicateMac {
+	var duplicates []*DuplicateMac
+	for vrf, routes := range rib {
+		// A static MAC may be configured on several VTEPs, e.g. behind an ethernet-segment
+		vteps := make(map[string]map[string]bool)
+		for _, r := range routes {
+			if r.RouteType == "mac-ip" && r.Origin == "originated" {
+				if vteps[r.MacAddress] == nil {
+					vteps[r.MacAddress] = make(map[string]bool)
+				}
+				vteps[r.MacAddress][r.NextHop] = true
+			}
+		}
+
+		found := make(map[string]bool)
+		for _, r := range routes {
+			static := vteps[r.MacAddress]
+			if r.RouteType != "mac-ip" || r.Origin != "received" || len(static) == 0 || static[r.NextHop] {
+				continue
+			}
+			for vtep := range static {
+				key := r.MacAddress + "/" + vtep + "/" + r.NextHop
+				if found[key] {
+					// MAC only and MAC/IP routes of the same host
+					continue
+				}
+				found[key] = true
+				duplicates = append(duplicates, &DuplicateMac{
+					Vrf:              vrf,
+					BgpInstance:      b.vniConfigs[vrf].BgpInstance,
+					MacAddress:       r.MacAddress,
+					Vtep:             vtep,
+					CompetingNextHop: r.NextHop,
+					CompetingRd:      r.RouteDistinguisher,
+					CompetingBest:    r.Best,
+				})
+			}
+		}
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Vrf != duplicates[j].Vrf {
+			return duplicates[i].Vrf < duplicates[j].Vrf
+		}
+		if duplicates[i].MacAddress != duplicates[j].MacAddress {
+			return duplicates[i].MacAddress < duplicates[j].MacAddress
+		}
+		if duplicates[i].Vtep != duplicates[j].Vtep {
+			return duplicates[i].Vtep < duplicates[j].Vtep
+		}
+		return duplicates[i].CompetingNextHop < duplicates[j].CompetingNextHop
+	})
+	return duplicates
+}
+
+// SendDuplicateMacs reports the duplicate MACs to the agent, unless nothing changed since the last report
+func (b *BGPSpeaker) SendDuplicateMacs(duplicates []*DuplicateMac) {
+	reports := []duplicateMacReport{}
+	for _, d := range duplicates {
+		reports = append(reports, duplicateMacReport{Vrf: d.Vrf, BgpInstance: d.BgpInstance, DuplicateMac: d})
+	}
+	str, err := json.Marshal(reports)
+	if err != nil {
+		b.logger.Error().Err(err).Msg("Can't encode duplicate MACs")
+		return
+	}
+	if bytes.Equal(str, b.lastDuplicates) {
+		return
+	}
+	b.lastDuplicates = str
+	b.SendToParentProcess("duplicate_macs", json.RawMessage(str))
+}
+
+// publishDuplicateMacs raises a duplicate-mac alarm in the state of the mac-vrf and logs it, and clears the ones that are gone
+func (a *Agent) publishDuplicateMacs(reports []duplicateMacReport) {
+	published := make(map[string]bool)
+
+	for _, r := range reports {
+		jsPath := fmt.Sprintf(".network_instance{.name==\"%s\"}.protocols.bgp_evpn.bgp_instance{.id==%s}.static_vxlan_agent.duplicate_mac{.mac_address==\"%s\",.vtep==\"%s\",.competing_next_hop==\"%s\"}", r.Vrf, r.BgpInstance, r.MacAddress, r.Vtep, r.CompetingNextHop)
+		if !a.duplicateMacs[jsPath] {
+			a.logger.Warn().Str("vrf", r.Vrf).Str("mac", r.MacAddress).Str("vtep", r.Vtep).Str("competing-next-hop", r.CompetingNextHop).Str("competing-rd", r.CompetingRd).Msg("Duplicate MAC detected")
+		}
+		a.updateTelemetry(jsPath, r.DuplicateMac)
+		published[jsPath] = true
+	}
+
+	for jsPath := range a.duplicateMacs {
+		if !published[jsPath] {
+			a.logger.Info().Str("path", jsPath).Msg("Duplicate MAC cleared")
+			a.deleteTelemetry(jsPath)
+		}
+	}
+	a.duplicateMacs = published
+}
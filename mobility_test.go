@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestFindDuplicateMacs(t *testing.T) {
+	b := newTestSpeaker()
+	b.vniConfigs = map[string]VniConfig{"mac-vrf-1": {BgpInstance: "1"}}
+
+	mac := func(origin string, address string, nextHop string, rd string) *RibRoute {
+		return &RibRoute{Origin: origin, RouteType: "mac-ip", MacAddress: address, NextHop: nextHop, RouteDistinguisher: rd}
+	}
+	competing := mac("received", "00:00:00:00:00:01", "3.3.3.3", "3.3.3.3:10")
+	competing.Best = true
+	// The MAC/IP route of the same host as the MAC only one
+	competingIp := mac("received", "00:00:00:00:00:01", "3.3.3.3", "3.3.3.3:10")
+	competingIp.IpAddress = "10.0.0.1"
+
+	got := b.findDuplicateMacs(map[string][]*RibRoute{
+		"mac-vrf-1": {
+			// Static on two VTEPs of an ethernet-segment
+			mac("originated", "00:00:00:00:00:01", "1.1.1.1", "1.1.1.1:10"),
+			mac("originated", "00:00:00:00:00:01", "2.2.2.2", "2.2.2.2:10"),
+			competing,
+			competingIp,
+			// Reflected from one of the static VTEPs
+			mac("received", "00:00:00:00:00:01", "2.2.2.2", "2.2.2.2:10"),
+			// Not static
+			mac("received", "00:00:00:00:00:02", "3.3.3.3", "3.3.3.3:10"),
+			{Origin: "received", RouteType: "imet", NextHop: "3.3.3.3"},
+		},
+		"mac-vrf-2": {
+			mac("originated", "00:00:00:00:00:03", "1.1.1.1", "1.1.1.1:20"),
+		},
+	})
+
+	want := []*DuplicateMac{
+		{Vrf: "mac-vrf-1", BgpInstance: "1", MacAddress: "00:00:00:00:00:01", Vtep: "1.1.1.1", CompetingNextHop: "3.3.3.3", CompetingRd: "3.3.3.3:10", CompetingBest: true},
+		{Vrf: "mac-vrf-1", BgpInstance: "1", MacAddress: "00:00:00:00:00:01", Vtep: "2.2.2.2", CompetingNextHop: "3.3.3.3", CompetingRd: "3.3.3.3:10", CompetingBest: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findDuplicateMacs() =")
+		for _, d := range got {
+			t.Errorf("  %+v", *d)
+		}
+	}
+}
+
+func TestPublishDuplicateMacs(t *testing.T) {
+	logger := zerolog.Nop()
+	telemetry := &testTelemetry{}
+	a := &Agent{logger: &logger, telemetryCtx: context.Background(), TelemetryServiceClient: telemetry, telemetry: make(map[string]string)}
+
+	report := func(vtep string) duplicateMacReport {
+		return duplicateMacReport{Vrf: "mac-vrf-1", BgpInstance: "1", DuplicateMac: &DuplicateMac{MacAddress: "00:00:00:00:00:01", Vtep: vtep, CompetingNextHop: "3.3.3.3"}}
+	}
+	path := func(vtep string) string {
+		return `.network_instance{.name=="mac-vrf-1"}.protocols.bgp_evpn.bgp_instance{.id==1}.static_vxlan_agent.duplicate_mac{.mac_address=="00:00:00:00:00:01",.vtep=="` + vtep + `",.competing_next_hop=="3.3.3.3"}`
+	}
+
+	a.publishDuplicateMacs([]duplicateMacReport{report("1.1.1.1"), report("2.2.2.2")})
+	if got, want := telemetry.updated(), [][]string{{path("1.1.1.1")}, {path("2.2.2.2")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first report published %v, want %v", got, want)
+	}
+
+	a.publishDuplicateMacs([]duplicateMacReport{report("2.2.2.2")})
+	if got, want := telemetry.deleted(), [][]string{{path("1.1.1.1")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second report deleted %v, want %v", got, want)
+	}
+
+	a.publishDuplicateMacs(nil)
+	if got, want := telemetry.deleted(), [][]string{{path("2.2.2.2")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("third report deleted %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+)
+
+// Stream responses buffered between the receiver and the dispatcher. A response carries a batch of notifications
+const notificationQueueSize = 64
+
+// StartConfigNotificationStream subscribes to all notifications of the agent. The returned channel is nil when ctx
+// is done before all subscriptions succeeded
+func (a *Agent) StartConfigNotificationStream(ctx context.Context) chan *ndk.NotificationStreamResponse {
+	streamID, ok := a.createNotificationSubscription(ctx)
+	if !ok {
+		return nil
+	}
+
+	a.logger.Info().
+		Uint64("stream-id", streamID).
+		Msg("Notification stream created")
+
+	notificationRegisterRequest := &ndk.NotificationRegisterRequest{
+		Op:       ndk.NotificationRegisterRequest_AddSubscription,
+		StreamId: streamID,
+		SubscriptionTypes: &ndk.NotificationRegisterRequest_Config{ // config
+			Config: &ndk.ConfigSubscriptionRequest{},
+		},
+	}
+	// The agent can't do anything without its configuration, the other subscriptions only refine its state
+	if !a.registerNotification(ctx, notificationRegisterRequest) {
+		return nil
+	}
+
+	// Network-instance notifications tell when the EVI or VNI of a mac-vrf may have changed,
+	// and together with interface notifications when the mac-vrf goes up or down.
+	// Route and BFD session notifications tell whether the static VTEPs are reachable, only the routes of the
+	// default network-instance matter
+	subscriptions := []*ndk.NotificationRegisterRequest{
+		{
+			Op:       ndk.NotificationRegisterRequest_AddSubscription,
+			StreamId: streamID,
+			SubscriptionTypes: &ndk.NotificationRegisterRequest_NwInst{
+				NwInst: &ndk.NetworkInstanceSubscriptionRequest{},
+			},
+		},
+		{
+			Op:       ndk.NotificationRegisterRequest_AddSubscription,
+			StreamId: streamID,
+			SubscriptionTypes: &ndk.NotificationRegisterRequest_Intf{
+				Intf: &ndk.InterfaceSubscriptionRequest{},
+			},
+		},
+		{
+			Op:       ndk.NotificationRegisterRequest_AddSubscription,
+			StreamId: streamID,
+			SubscriptionTypes: &ndk.NotificationRegisterRequest_Route{
+				Route: &ndk.IpRouteSubscriptionRequest{Key: &ndk.RouteKeyPb{NetInstName: "default"}},
+			},
+		},
+		{
+			Op:       ndk.NotificationRegisterRequest_AddSubscription,
+			StreamId: streamID,
+			SubscriptionTypes: &ndk.NotificationRegisterRequest_BfdSession{
+				BfdSession: &ndk.BfdSessionSubscriptionRequest{},
+			},
+		},
+	}
+	for _, req := range subscriptions {
+		a.registerOptionalNotification(ctx, req)
+	}
+
+	streamChan := make(chan *ndk.NotificationStreamResponse, notificationQueueSize)
+	go a.startNotificationStream(ctx, notificationRegisterRequest, streamChan)
+
+	return streamChan
+}
+
+// createNotificationSubscription creates a subscription and return the Stream ID.
+// Stream ID is used to register notifications for other services.
+func (a *Agent) createNotificationSubscription(ctx context.Context) (uint64, bool) {
+	for {
+		// get subscription and streamID
+		notificationResponse, err := a.SDKMgrServiceClient.NotificationRegister(ctx,
+			&ndk.NotificationRegisterRequest{
+				Op: ndk.NotificationRegisterRequest_Create,
+			})
+		if err != nil || notificationResponse.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+			a.logger.Warn().Err(err).
+				Str("status", notificationResponse.GetStatus().String()).
+				Dur("retry-in", a.retryTimeout).
+				Msg("Could not register for notifications")
+
+			if !a.waitRetry(ctx) {
+				return 0, false
+			}
+			continue
+		}
+
+		return notificationResponse.GetStreamId(), true
+	}
+}
+
+// startNotificationStream receives the notifications of the stream and queues them for the dispatcher until ctx is
+// done, then closes streamChan. The stream belongs to ctx, so Recv returns as soon as ctx is cancelled
+func (a *Agent) startNotificationStream(ctx context.Context, req *ndk.NotificationRegisterRequest,
+	streamChan chan *ndk.NotificationStreamResponse) {
+
+	a.logger.Info().
+		Uint64("stream-id", req.GetStreamId()).
+		Str("subscription-type", subscriptionTypeName(req)).
+		Msg("Starting streaming notifications")
+	defer close(streamChan)
+
+	var stream ndk.SdkNotificationService_NotificationStreamClient
+	for {
+		if stream == nil {
+			if stream = a.getNotificationStreamClient(ctx, req); stream == nil {
+				return
+			}
+		}
+
+		ev, err := stream.Recv()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// A stream doesn't recover from an error, a new one is acquired
+			if err == io.EOF {
+				a.logger.Warn().
+					Str("subscription-type", subscriptionTypeName(req)).
+					Dur("retry-in", a.retryTimeout).
+					Msg("Received EOF for notification stream")
+			} else {
+				a.logger.Warn().Err(err).
+					Dur("retry-in", a.retryTimeout).
+					Msg("Failed to receive notification")
+			}
+			stream = nil
+			if !a.waitRetry(ctx) {
+				return
+			}
+			continue
+		}
+
+		if !a.queueNotification(ctx, streamChan, ev) {
+			return
+		}
+	}
+}
+
+// queueNotification hands a stream response to the dispatcher. When the queue is full it waits, which stops reading
+// the stream so NDK holds back the next notifications, and reports how long for the back-pressure metrics.
+// It returns false when ctx is done first
+func (a *Agent) queueNotification(ctx context.Context, streamChan chan *ndk.NotificationStreamResponse,
+	ev *ndk.NotificationStreamResponse) bool {
+
+	select {
+	case streamChan <- ev:
+		a.metrics.NotificationQueueDepth(len(streamChan))
+		return true
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case streamChan <- ev:
+		a.metrics.NotificationQueueFull(time.Since(start))
+		a.metrics.NotificationQueueDepth(len(streamChan))
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Events of the background components of the ConfigurationManager, dispatched together with the NDK notifications
+type (
+	// A VTEP whose reachability changed, or "" once the routes are replayed
+	vtepEvent string
+	// A mac-vrf whose learned MACs changed
+	macDiscoveryEvent string
+	// The EVI or VNI of some network-instances got resolved
+	resolverEvent struct{}
+)
+
+// dispatchNotifications routes NDK stream responses and the events of the background components to the handlers
+// of the ConfigurationManager. All of them go through here, one at a time
+func (a *Agent) dispatchNotifications(event interface{}) {
+	switch e := event.(type) {
+	case *ndk.NotificationStreamResponse:
+		for _, n := range e.GetNotification() {
+			a.dispatchNotification(n)
+		}
+	case vtepEvent:
+		a.metrics.Notification("vtep")
+		a.configManager.processVtepEvent(a, string(e))
+	case macDiscoveryEvent:
+		a.metrics.Notification("mac_discovery")
+		a.configManager.processMacDiscoveryEvent(a, string(e))
+	case resolverEvent:
+		a.metrics.Notification("resolver")
+		a.configManager.processResolverEvent(a)
+	default:
+		a.logger.Warn().Str("event", fmt.Sprintf("%T", event)).Msg("Ignoring event without handler")
+	}
+}
+
+func (a *Agent) dispatchNotification(n *ndk.Notification) {
+	var kind string
+	switch t := n.GetSubscriptionTypes().(type) {
+	case *ndk.Notification_Config:
+		kind = "config"
+		a.configManager.processNotification(a, t.Config)
+	case *ndk.Notification_NwInst:
+		kind = "nw_inst"
+		a.configManager.processNetworkInstance(a, t.NwInst)
+	case *ndk.Notification_Intf:
+		kind = "intf"
+		a.configManager.processInterface(a, t.Intf)
+	case *ndk.Notification_Route:
+		kind = "route"
+		a.configManager.processRoute(a, t.Route)
+	case *ndk.Notification_BfdSession:
+		kind = "bfd_session"
+		a.configManager.processBfdSession(a, t.BfdSession)
+	default:
+		kind = "unknown"
+		a.logger.Debug().Msg("Ignoring notification without handler")
+	}
+	a.metrics.Notification(kind)
+}
+
+// subscriptionTypeName returns the name of the enclosed subscription type
+func subscriptionTypeName(r *ndk.NotificationRegisterRequest) string {
+	var sType string
+	switch r.GetSubscriptionTypes().(type) {
+	case *ndk.NotificationRegisterRequest_Config:
+		sType = "config"
+	case *ndk.NotificationRegisterRequest_Appid:
+		sType = "app id"
+	case *ndk.NotificationRegisterRequest_Route:
+		sType = "route"
+	case *ndk.NotificationRegisterRequest_BfdSession:
+		sType = "bfd"
+	case *ndk.NotificationRegisterRequest_Intf:
+		sType = "interface"
+	case *ndk.NotificationRegisterRequest_LldpNeighbor:
+		sType = "lldp"
+	case *ndk.NotificationRegisterRequest_Nhg:
+		sType = "next-hop group"
+	case *ndk.NotificationRegisterRequest_NwInst:
+		sType = "network instance"
+	}
+
+	return sType
+}
+
+// getNotificationStreamClient acquires the notification stream client that is used to receive
+// streamed notifications, nil when ctx is done first. The subscriptions of the stream are registered by
+// StartConfigNotificationStream
+func (a *Agent) getNotificationStreamClient(
+	ctx context.Context,
+	req *ndk.NotificationRegisterRequest) ndk.SdkNotificationService_NotificationStreamClient {
+
+	for {
+		streamClient, err := a.NotificationServiceClient.NotificationStream(ctx,
+			&ndk.NotificationStreamRequest{
+				StreamId: req.GetStreamId(),
+			})
+		if err != nil {
+			a.logger.Warn().Err(err).
+				Str("subscription-type", subscriptionTypeName(req)).
+				Dur("retry-in", a.retryTimeout).
+				Msg("Failed creating stream client")
+
+			if !a.waitRetry(ctx) {
+				return nil
+			}
+			continue
+		}
+
+		return streamClient
+	}
+}
+
+// registerNotification adds a subscription to a notification stream, retrying until it succeeds.
+// It returns false when ctx is done first
+func (a *Agent) registerNotification(ctx context.Context, req *ndk.NotificationRegisterRequest) bool {
+	for {
+		registerResponse, err := a.SDKMgrServiceClient.NotificationRegister(ctx, req)
+		if err != nil || registerResponse.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+			a.logger.Warn().Err(err).
+				Str("subscription-type", subscriptionTypeName(req)).
+				Dur("retry-in", a.retryTimeout).
+				Msg("Failed registering to notification")
+
+			if !a.waitRetry(ctx) {
+				return false
+			}
+			continue
+		}
+		return true
+	}
+}
+
+// registerOptionalNotification adds a subscription the agent can run without. When it fails the agent carries on
+// with what it knows, e.g. VTEPs stay in reachability unknown, rather than holding back its configuration
+func (a *Agent) registerOptionalNotification(ctx context.Context, req *ndk.NotificationRegisterRequest) {
+	registerResponse, err := a.SDKMgrServiceClient.NotificationRegister(ctx, req)
+	if err != nil || registerResponse.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+		a.logger.Error().Err(err).
+			Str("subscription-type", subscriptionTypeName(req)).
+			Str("status", registerResponse.GetStatus().String()).
+			Msg("Failed registering to notification, running without it")
+	}
+}
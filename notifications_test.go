@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+// testSdkMgr records the subscriptions of the agent, the ones of the failing types are refused
+type testSdkMgr struct {
+	ndk.SdkMgrServiceClient
+	mu         sync.Mutex
+	registered []string
+	failing    map[string]bool
+}
+
+func (s *testSdkMgr) NotificationRegister(ctx context.Context, in *ndk.NotificationRegisterRequest, opts ...grpc.CallOption) (*ndk.NotificationRegisterResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if in.GetOp() == ndk.NotificationRegisterRequest_Create {
+		return &ndk.NotificationRegisterResponse{Status: ndk.SdkMgrStatus_kSdkMgrSuccess, StreamId: 1}, nil
+	}
+	sType := subscriptionTypeName(in)
+	s.registered = append(s.registered, sType)
+	if s.failing[sType] {
+		return &ndk.NotificationRegisterResponse{Status: ndk.SdkMgrStatus_kSdkMgrFailed}, nil
+	}
+	return &ndk.NotificationRegisterResponse{Status: ndk.SdkMgrStatus_kSdkMgrSuccess}, nil
+}
+
+func (s *testSdkMgr) subscriptions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.registered...)
+}
+
+// testNotificationStream streams the responses of its channel, Recv blocks like a gRPC stream until ctx is done
+type testNotificationStream struct {
+	ndk.SdkNotificationServiceClient
+	grpc.ClientStream
+	ctx       context.Context
+	responses chan *ndk.NotificationStreamResponse
+}
+
+func (s *testNotificationStream) NotificationStream(ctx context.Context, in *ndk.NotificationStreamRequest, opts ...grpc.CallOption) (ndk.SdkNotificationService_NotificationStreamClient, error) {
+	s.ctx = ctx
+	return s, nil
+}
+
+func (s *testNotificationStream) Recv() (*ndk.NotificationStreamResponse, error) {
+	select {
+	case r := <-s.responses:
+		return r, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func newTestNotificationAgent(t *testing.T, failing ...string) (*Agent, *testSdkMgr, *testNotificationStream) {
+	_, agent, _ := newTestConfigurationManager(t)
+	sdkMgr := &testSdkMgr{failing: make(map[string]bool)}
+	for _, sType := range failing {
+		sdkMgr.failing[sType] = true
+	}
+	stream := &testNotificationStream{responses: make(chan *ndk.NotificationStreamResponse)}
+	agent.SDKMgrServiceClient = sdkMgr
+	agent.NotificationServiceClient = stream
+	agent.retryTimeout = time.Millisecond
+	return agent, sdkMgr, stream
+}
+
+func TestStartConfigNotificationStream(t *testing.T) {
+	agent, sdkMgr, stream := newTestNotificationAgent(t, "route")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	configChan := agent.StartConfigNotificationStream(ctx)
+	if configChan == nil {
+		t.Fatal("no stream when an optional subscription fails")
+	}
+	subscriptions := sdkMgr.subscriptions()
+	if len(subscriptions) == 0 || subscriptions[0] != "config" {
+		t.Fatalf("subscriptions %v, want config first", subscriptions)
+	}
+	for _, sType := range subscriptions[1:] {
+		if sType == "config" {
+			t.Errorf("config subscription registered twice: %v", subscriptions)
+		}
+	}
+
+	response := &ndk.NotificationStreamResponse{}
+	stream.responses <- response
+	if got := <-configChan; got != response {
+		t.Errorf("received %v, want %v", got, response)
+	}
+	if got := sdkMgr.subscriptions(); len(got) != len(subscriptions) {
+		t.Errorf("subscriptions %v registered again by the stream", got[len(subscriptions):])
+	}
+
+	// The receiver blocked in Recv returns and closes the channel
+	cancel()
+	select {
+	case _, ok := <-configChan:
+		if ok {
+			t.Error("notification received after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+func TestStartConfigNotificationStreamWithoutConfig(t *testing.T) {
+	agent, sdkMgr, _ := newTestNotificationAgent(t, "config")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The config subscription is retried until ctx is done, the others aren't registered without it
+	if configChan := agent.StartConfigNotificationStream(ctx); configChan != nil {
+		t.Fatal("stream without the config subscription")
+	}
+	for _, sType := range sdkMgr.subscriptions() {
+		if sType != "config" {
+			t.Errorf("%s subscription registered without config", sType)
+		}
+	}
+}
+
+func TestQueueNotificationFull(t *testing.T) {
+	agent, _, _ := newTestNotificationAgent(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamChan := make(chan *ndk.NotificationStreamResponse, 1)
+
+	if !agent.queueNotification(ctx, streamChan, &ndk.NotificationStreamResponse{}) {
+		t.Fatal("not queued")
+	}
+	if got := testutil.ToFloat64(agent.metrics.queueDepth); got != 1 {
+		t.Errorf("queue depth %v, want 1", got)
+	}
+
+	// A full queue waits for the dispatcher
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-streamChan
+	}()
+	if !agent.queueNotification(ctx, streamChan, &ndk.NotificationStreamResponse{}) {
+		t.Fatal("not queued once the dispatcher caught up")
+	}
+	if got := testutil.ToFloat64(agent.metrics.queueFull); got != 1 {
+		t.Errorf("queue full %v times, want 1", got)
+	}
+
+	// Until ctx is done
+	cancel()
+	if agent.queueNotification(ctx, streamChan, &ndk.NotificationStreamResponse{}) {
+		t.Error("queued after cancel")
+	}
+}
+
+func TestDispatchNotifications(t *testing.T) {
+	c, agent, stdin := newTestConfigurationManager(t)
+	agent.configManager = c
+	vniConfig := `{"admin_state": "ADMIN_STATE_enable", "evi": {"value": "1"}, "vni": {"value": "10"}}`
+
+	agent.dispatchNotifications(&ndk.NotificationStreamResponse{
+		Notification: []*ndk.Notification{
+			{SubscriptionTypes: &ndk.Notification_NwInst{
+				NwInst: &ndk.NetworkInstanceNotification{
+					Op:  ndk.SdkMgrOperation_Create,
+					Key: &ndk.NetworkInstanceKey{InstName: "mac-vrf-2"},
+				},
+			}},
+			{SubscriptionTypes: &ndk.Notification_Config{
+				Config: configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, []string{"mac-vrf-1", "1"}, vniConfig),
+			}},
+			{SubscriptionTypes: &ndk.Notification_Config{Config: commitEnd}},
+		},
+	})
+	if lastVrfMessage(t, stdin)["mac-vrf-1"] == nil {
+		t.Error("config notifications not handled")
+	}
+	agent.dispatchNotifications(resolverEvent{})
+	// Events without a handler are dropped
+	agent.dispatchNotifications(42)
+
+	for kind, want := range map[string]float64{"config": 2, "nw_inst": 1, "resolver": 1} {
+		if got := testutil.ToFloat64(agent.metrics.notifications.WithLabelValues(kind)); got != want {
+			t.Errorf("%d %s notifications counted, want %v", int(got), kind, want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// Paths sent per AddPathStream request. gobgp installs each request in a single management operation
+const pathBatchSize = 1000
+
+// apiSocketDir creates a private directory for the socket on which the speaker serves the gobgp API to itself,
+// for AddPathStream which BgpServer doesn't expose. The API is unauthenticated, so only the agent may connect
+func apiSocketDir() (string, error) {
+	return ioutil.TempDir("", "static-vxlan-agent-gobgp-")
+}
+
+func apiSocket(dir string) string {
+	return filepath.Join(dir, "gobgp.sock")
+}
+
+// connectApi connects the client used to stream paths to the gobgp API of the speaker
+func (b *BGPSpeaker) connectApi() {
+	if b.socketDir == "" {
+		b.logger.Warn().Msg("No gobgp API socket, adding paths one by one")
+		return
+	}
+	// gobgp starts listening in the background, wait until it does
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+apiSocket(b.socketDir), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("Can't connect to gobgp API, adding paths one by one")
+		return
+	}
+	if err := os.Chmod(apiSocket(b.socketDir), 0600); err != nil {
+		b.logger.Warn().Err(err).Msg("Can't restrict gobgp API socket")
+	}
+	b.conn = conn
+	b.client = api.NewGobgpApiClient(conn)
+}
+
+// removeApiSocket removes the directory of the gobgp API socket
+func (b *BGPSpeaker) removeApiSocket() {
+	if b.socketDir == "" {
+		return
+	}
+	if err := os.RemoveAll(b.socketDir); err != nil {
+		b.logger.Warn().Err(err).Str("dir", b.socketDir).Msg("Can't remove gobgp API socket")
+	}
+	b.socketDir = ""
+}
+
+// pathDiff returns the paths to add because they are new or changed, and the ones to withdraw, of the VRFs in desired
+func (b *BGPSpeaker) pathDiff(desired map[string]map[string]*originatedPath) ([]*originatedPath, []*originatedPath) {
+	var added, withdrawn []*originatedPath
+	for vrf, paths := range desired {
+		originated := b.originated[vrf]
+		for key, p := range paths {
+			if old, found := originated[key]; !found || !proto.Equal(old.path, p.path) {
+				added = append(added, p)
+			}
+		}
+		for key, p := range originated {
+			if _, found := paths[key]; !found {
+				withdrawn = append(withdrawn, p)
+			}
+		}
+	}
+	return added, withdrawn
+}
+
+// ProgramPaths applies a diff of the originated paths to the RIB, in batches over AddPathStream.
+// When streaming fails the paths are programmed one by one, adding a path again is harmless.
+// Only the paths that got programmed are recorded as originated, the next VRF configs retry the others
+func (b *BGPSpeaker) ProgramPaths(added []*originatedPath, withdrawn []*originatedPath) {
+	if len(added) == 0 && len(withdrawn) == 0 {
+		return
+	}
+
+	var paths []*api.Path
+	for _, p := range withdrawn {
+		path := proto.Clone(p.path).(*api.Path)
+		path.IsWithdraw = true
+		paths = append(paths, path)
+	}
+	for _, p := range added {
+		paths = append(paths, p.path)
+	}
+
+	if err := b.streamPaths(paths); err == nil {
+		for _, p := range withdrawn {
+			b.recordPath(p, false)
+		}
+		for _, p := range added {
+			b.recordPath(p, true)
+		}
+		b.logger.Debug().Int("added", len(added)).Int("withdrawn", len(withdrawn)).Msg("Streamed path changes")
+		return
+	} else if b.client != nil {
+		b.logger.Warn().Err(err).Msg("Can't stream paths, adding them one by one")
+	}
+
+	for _, p := range withdrawn {
+		if b.DeletePath(p.path) {
+			b.recordPath(p, false)
+		} else {
+			b.rebuildAll = true
+		}
+	}
+	for _, p := range added {
+		if b.AddPath(p.path) {
+			b.recordPath(p, true)
+		} else {
+			b.rebuildAll = true
+		}
+	}
+}
+
+// recordPath updates the model of originated paths with a programmed path
+func (b *BGPSpeaker) recordPath(p *originatedPath, advertised bool) {
+	b.countRoute(p.vrf, advertised)
+	if !advertised {
+		delete(b.originated[p.vrf], pathKey(p.path))
+		if len(b.originated[p.vrf]) == 0 {
+			delete(b.originated, p.vrf)
+		}
+		return
+	}
+	if b.originated == nil {
+		b.originated = make(map[string]map[string]*originatedPath)
+	}
+	if b.originated[p.vrf] == nil {
+		b.originated[p.vrf] = make(map[string]*originatedPath)
+	}
+	b.originated[p.vrf][pathKey(p.path)] = p
+}
+
+func (b *BGPSpeaker) streamPaths(paths []*api.Path) error {
+	if b.client == nil {
+		return fmt.Errorf("not connected to gobgp API")
+	}
+	stream, err := b.client.AddPathStream(context.Background())
+	if err != nil {
+		return err
+	}
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > pathBatchSize {
+			n = pathBatchSize
+		}
+		if err := stream.Send(&api.AddPathStreamRequest{TableType: api.TableType_GLOBAL, Paths: paths[:n]}); err != nil {
+			return err
+		}
+		paths = paths[n:]
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// ReconcilePaths rebuilds the model of originated paths from the RIB, so the next configs are diffed
+// against what the speaker actually advertises. All VRFs are built again with the next configs
+func (b *BGPSpeaker) ReconcilePaths() {
+	vrfs := make(map[string]string)
+	for vrf, paths := range b.originated {
+		for key := range paths {
+			vrfs[key] = vrf
+		}
+	}
+
+	originated := make(map[string]map[string]*originatedPath)
+	count := 0
+	for _, path := range b.GetRib() {
+		if !isOriginated(path) {
+			continue
+		}
+		key := pathKey(path)
+		vrf, found := vrfs[key]
+		if !found {
+			vrf = "unknown"
+		}
+		if originated[vrf] == nil {
+			originated[vrf] = make(map[string]*originatedPath)
+		}
+		originated[vrf][key] = &originatedPath{vrf: vrf, path: path}
+		count++
+	}
+	b.originated = originated
+	b.rebuildAll = true
+	b.logger.Info().Int("paths", count).Msg("Reconciled originated paths with the RIB")
+}
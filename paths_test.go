@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testMacVrf(evi string, vtep string, macs ...string) *VniConfig {
+	return &VniConfig{Evi: evi, Vni: evi, Vteps: map[string]Vtep{vtep: {Address: vtep, StaticMacs: macs}}}
+}
+
+func TestPathDiff(t *testing.T) {
+	b := newTestSpeaker()
+	b.vniConfigs = map[string]VniConfig{
+		"mac-vrf-1": *testMacVrf("10", "1.1.1.1", "00:00:00:00:00:01"),
+		"mac-vrf-2": *testMacVrf("20", "1.1.1.1", "00:00:00:00:00:02"),
+	}
+	initial := b.originatedPaths(map[string]bool{"mac-vrf-1": true, "mac-vrf-2": true})
+
+	tests := []struct {
+		name      string
+		configs   map[string]*VniConfig
+		added     int
+		withdrawn int
+	}{
+		{name: "unchanged", configs: map[string]*VniConfig{"mac-vrf-1": testMacVrf("10", "1.1.1.1", "00:00:00:00:00:01")}},
+		{name: "MAC moved", configs: map[string]*VniConfig{"mac-vrf-1": testMacVrf("10", "1.1.1.1", "00:00:00:00:00:03")}, added: 1, withdrawn: 1},
+		{name: "VRF deleted", configs: map[string]*VniConfig{"mac-vrf-2": nil}, withdrawn: 2},
+		{name: "VRF added", configs: map[string]*VniConfig{"mac-vrf-3": testMacVrf("30", "1.1.1.1")}, added: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.vniConfigs = map[string]VniConfig{
+				"mac-vrf-1": *testMacVrf("10", "1.1.1.1", "00:00:00:00:00:01"),
+				"mac-vrf-2": *testMacVrf("20", "1.1.1.1", "00:00:00:00:00:02"),
+			}
+			b.originated = initial
+			vrfs := make(map[string]bool)
+			for vrf, config := range tt.configs {
+				if config == nil {
+					delete(b.vniConfigs, vrf)
+				} else {
+					b.vniConfigs[vrf] = *config
+				}
+				vrfs[vrf] = true
+			}
+
+			// The VRFs that didn't change aren't diffed at all
+			desired := b.originatedPaths(vrfs)
+			for vrf := range desired {
+				if !vrfs[vrf] && vrf != esRoutesVrf {
+					t.Errorf("originatedPaths() built unchanged %s", vrf)
+				}
+			}
+			added, withdrawn := b.pathDiff(desired)
+			if len(added) != tt.added || len(withdrawn) != tt.withdrawn {
+				t.Errorf("pathDiff() added %d withdrawn %d, want %d and %d", len(added), len(withdrawn), tt.added, tt.withdrawn)
+			}
+			for _, p := range append(added, withdrawn...) {
+				if !vrfs[p.vrf] {
+					t.Errorf("pathDiff() changed %s of unchanged %s", pathKey(p.path), p.vrf)
+				}
+			}
+		})
+	}
+}
+
+func TestReadMessages(t *testing.T) {
+	b := newTestSpeaker()
+	// Not running, the configs are only recorded
+	b.readMessages(strings.NewReader(`{"key": "vrf", "data": {"mac-vrf-1": {"evi": "10"}, "mac-vrf-2": {"evi": "20"}}}
+not a message
+{"key": "vrf", "data": {"mac-vrf-1": null, "mac-vrf-2": {"evi": "21"}}}
+{"key": "es", "data": {"es-1": {"esi": "01:11:22:33:44:55:66:00:01:00"}}}
+`))
+
+	if want := map[string]VniConfig{"mac-vrf-2": {Evi: "21"}}; !reflect.DeepEqual(b.vniConfigs, want) {
+		t.Errorf("vniConfigs = %+v, want %+v", b.vniConfigs, want)
+	}
+	if !b.rebuildAll {
+		t.Errorf("changed ethernet segments don't rebuild all VRFs")
+	}
+}
+
+// As after a change of the ethernet segments or the export policy, all VRFs are rebuilt
+func TestPathDiffAllVrfs(t *testing.T) {
+	b := newTestSpeaker()
+	initial := allPaths(b, testVniConfigs(2, 2, 2, 0))
+
+	tests := []struct {
+		name      string
+		configs   map[string]VniConfig
+		added     int
+		withdrawn int
+	}{
+		{name: "unchanged", configs: testVniConfigs(2, 2, 2, 0)},
+		// Each VTEP replaces both its MACs
+		{name: "MACs moved", configs: testVniConfigs(2, 2, 2, 2), added: 8, withdrawn: 8},
+		{name: "VRF deleted", configs: testVniConfigs(1, 2, 2, 0), withdrawn: 6},
+		{name: "VTEP added", configs: testVniConfigs(2, 3, 2, 0), added: 6},
+		{name: "everything deleted", configs: map[string]VniConfig{}, withdrawn: 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.originated = initial
+			b.vniConfigs = tt.configs
+			vrfs := make(map[string]bool)
+			for vrf := range initial {
+				vrfs[vrf] = true
+			}
+			for vrf := range tt.configs {
+				vrfs[vrf] = true
+			}
+			added, withdrawn := b.pathDiff(b.originatedPaths(vrfs))
+			if len(added) != tt.added || len(withdrawn) != tt.withdrawn {
+				t.Errorf("pathDiff() added %d withdrawn %d, want %d and %d", len(added), len(withdrawn), tt.added, tt.withdrawn)
+			}
+		})
+	}
+}
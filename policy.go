@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/osrg/gobgp/v3/api"
+)
+
+// gobgp can't match on the MAC of a route, so the speaker marks the MAC/IP routes matched by a statement
+// with the large community <local-as>:<policyMarker>:<sequence-id>. The policy removes the markers again
+const policyMarker = 4294967295
+
+// PolicyStatement is a statement of a routing policy of the agent, evaluated in the order of its sequence-id
+type PolicyStatement struct {
+	SequenceId uint32 `json:"sequence_id"`
+
+	MacVrf     string `json:"mac_vrf,omitempty"`
+	Vtep       string `json:"vtep,omitempty"`
+	MacAddress string `json:"mac_address,omitempty"`
+
+	// accept, reject or next-statement
+	Result          string   `json:"policy_result"`
+	AddCommunities  []string `json:"add_community,omitempty"`
+	LocalPreference string   `json:"local_preference,omitempty"`
+	Med             string   `json:"med,omitempty"`
+}
+
+// RoutingPolicy is an import or export policy of the speaker
+type RoutingPolicy struct {
+	DefaultAction string             `json:"default_action"`
+	Statements    []*PolicyStatement `json:"statements"`
+}
+
+// policyResult trims the NDK enum prefix, e.g. POLICY_RESULT_reject
+func policyResult(value string) string {
+	for _, prefix := range []string{"POLICY_RESULT_", "DEFAULT_ACTION_"} {
+		value = strings.TrimPrefix(value, prefix)
+	}
+	return strings.ReplaceAll(value, "_", "-")
+}
+
+func routeAction(result string) api.RouteAction {
+	switch policyResult(result) {
+	case "reject":
+		return api.RouteAction_REJECT
+	case "next-statement":
+		return api.RouteAction_NONE
+	}
+	return api.RouteAction_ACCEPT
+}
+
+// Sorted returns the statements in order of their sequence-id
+func (p *RoutingPolicy) Sorted() []*PolicyStatement {
+	statements := append([]*PolicyStatement{}, p.Statements...)
+	sort.Slice(statements, func(i, j int) bool { return statements[i].SequenceId < statements[j].SequenceId })
+	return statements
+}
+
+// macMarkers returns the markers of the export statements matching a MAC
+func (b *BGPSpeaker) macMarkers(mac string) []*api.LargeCommunity {
+	var markers []*api.LargeCommunity
+	if b.exportPolicy == nil {
+		return markers
+	}
+	for _, s := range b.exportPolicy.Statements {
+		if s.MacAddress != "" && strings.EqualFold(s.MacAddress, mac) {
+			markers = append(markers, &api.LargeCommunity{GlobalAdmin: b.LocalAS, LocalData1: policyMarker, LocalData2: s.SequenceId})
+		}
+	}
+	return markers
+}
+
+// policyApi converts a routing policy to gobgp defined sets and a policy.
+// A statement matching a mac-vrf that isn't advertised is left out, as it can't match any route
+func (b *BGPSpeaker) policyApi(direction string, p *RoutingPolicy) ([]*api.DefinedSet, *api.Policy) {
+	var sets []*api.DefinedSet
+	policy := &api.Policy{Name: "static-vxlan-agent-" + direction}
+	removeMarkers := &api.CommunityAction{
+		Type:        api.CommunityAction_REMOVE,
+		Communities: []string{fmt.Sprintf("^%d:%d:\\d+$", b.LocalAS, uint32(policyMarker))},
+	}
+
+	for _, s := range p.Sorted() {
+		name := fmt.Sprintf("%s-%d", direction, s.SequenceId)
+		conditions := &api.Conditions{}
+
+		if s.MacVrf != "" {
+			vrfConfig, found := b.vniConfigs[s.MacVrf]
+			if !found {
+				b.logger.Debug().Str("statement", name).Str("mac-vrf", s.MacVrf).Msg("mac-vrf not advertised, skipping statement")
+				continue
+			}
+			sets = append(sets, &api.DefinedSet{
+				DefinedType: api.DefinedType_EXT_COMMUNITY,
+				Name:        name + "-mac-vrf",
+				List:        []string{fmt.Sprintf("rt:^%d:%s$", b.LocalAS, vrfConfig.Evi)},
+			})
+			conditions.ExtCommunitySet = &api.MatchSet{Type: api.MatchSet_ANY, Name: name + "-mac-vrf"}
+		}
+		if s.Vtep != "" {
+			conditions.NextHopInList = []string{s.Vtep}
+		}
+		// Only originated routes have markers
+		if s.MacAddress != "" && direction == "export" {
+			sets = append(sets, &api.DefinedSet{
+				DefinedType: api.DefinedType_LARGE_COMMUNITY,
+				Name:        name + "-mac",
+				List:        []string{fmt.Sprintf("^%d:%d:%d$", b.LocalAS, uint32(policyMarker), s.SequenceId)},
+			})
+			conditions.LargeCommunitySet = &api.MatchSet{Type: api.MatchSet_ANY, Name: name + "-mac"}
+		}
+
+		actions := &api.Actions{
+			RouteAction:    routeAction(s.Result),
+			LargeCommunity: removeMarkers,
+		}
+		if len(s.AddCommunities) > 0 {
+			actions.Community = &api.CommunityAction{Type: api.CommunityAction_ADD, Communities: s.AddCommunities}
+		}
+		if s.LocalPreference != "" {
+			actions.LocalPref = &api.LocalPrefAction{Value: getUint32FromJson(s.LocalPreference)}
+		}
+		if s.Med != "" {
+			actions.Med = &api.MedAction{Type: api.MedAction_REPLACE, Value: int64(getUint32FromJson(s.Med))}
+		}
+		policy.Statements = append(policy.Statements, &api.Statement{Name: name, Conditions: conditions, Actions: actions})
+	}
+
+	// Routes that match no statement get the default action, without their markers
+	policy.Statements = append(policy.Statements, &api.Statement{
+		Name:       direction + "-default",
+		Conditions: &api.Conditions{},
+		Actions:    &api.Actions{RouteAction: routeAction(p.DefaultAction), LargeCommunity: removeMarkers},
+	})
+	return sets, policy
+}
+
+// policyAssignments converts the import and export policies, by gobgp direction
+func (b *BGPSpeaker) policyAssignments() ([]*api.DefinedSet, []*api.PolicyAssignment) {
+	var sets []*api.DefinedSet
+	var assignments []*api.PolicyAssignment
+	for _, p := range []struct {
+		name      string
+		direction api.PolicyDirection
+		policy    *RoutingPolicy
+	}{
+		{"import", api.PolicyDirection_IMPORT, b.importPolicy},
+		{"export", api.PolicyDirection_EXPORT, b.exportPolicy},
+	} {
+		if p.policy == nil {
+			continue
+		}
+		s, policy := b.policyApi(p.name, p.policy)
+		sets = append(sets, s...)
+		assignments = append(assignments, &api.PolicyAssignment{
+			Name:          "global",
+			Direction:     p.direction,
+			Policies:      []*api.Policy{policy},
+			DefaultAction: routeAction(p.policy.DefaultAction),
+		})
+	}
+	return sets, assignments
+}
+
+// ApplyPolicies replaces the global import and export policies of the speaker
+func (b *BGPSpeaker) ApplyPolicies(sets []*api.DefinedSet, assignments []*api.PolicyAssignment) error {
+	// Unassign first, an assigned policy can't be replaced
+	for _, direction := range []api.PolicyDirection{api.PolicyDirection_IMPORT, api.PolicyDirection_EXPORT} {
+		if err := b.s.SetPolicyAssignment(context.Background(), &api.SetPolicyAssignmentRequest{
+			Assignment: &api.PolicyAssignment{Name: "global", Direction: direction, DefaultAction: api.RouteAction_ACCEPT},
+		}); err != nil {
+			return err
+		}
+	}
+
+	var policies []*api.Policy
+	for _, a := range assignments {
+		policies = append(policies, a.Policies...)
+	}
+	if err := b.s.SetPolicies(context.Background(), &api.SetPoliciesRequest{DefinedSets: sets, Policies: policies}); err != nil {
+		return err
+	}
+	for _, a := range assignments {
+		if err := b.s.SetPolicyAssignment(context.Background(), &api.SetPolicyAssignmentRequest{Assignment: a}); err != nil {
+			return err
+		}
+	}
+
+	b.logger.Info().Int("policies", len(policies)).Msg("Applied routing policies")
+	return nil
+}
+
+// syncPolicies applies the routing policies when they or the EVIs they match on changed
+func (b *BGPSpeaker) syncPolicies() {
+	sets, assignments := b.policyAssignments()
+	applied, _ := json.Marshal([]interface{}{sets, assignments})
+	if bytes.Equal(applied, b.appliedPolicy) {
+		return
+	}
+	if err := b.ApplyPolicies(sets, assignments); err != nil {
+		b.logger.Error().Err(err).Msg("Can't apply routing policies")
+		return
+	}
+	b.appliedPolicy = applied
+
+	// Re-evaluate the routes already exchanged with the peer through the new policies
+	if err := b.s.ResetPeer(context.Background(), &api.ResetPeerRequest{
+		Address:   b.Neighbour,
+		Soft:      true,
+		Direction: api.ResetPeerRequest_BOTH,
+	}); err != nil {
+		b.logger.Debug().Err(err).Msg("Can't soft reset peer after policy change")
+	}
+}
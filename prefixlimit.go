@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+)
+
+// MaxPrefixConfig limits the number of routes received from the peer for an address family
+type MaxPrefixConfig struct {
+	MaxRoutes           uint32 `json:"max_received_routes"`
+	WarningThresholdPct uint32 `json:"warning_threshold_pct"`
+	// log, tear-down or restart
+	Action          string `json:"action"`
+	RestartInterval uint32 `json:"restart_interval"`
+}
+
+// The families of the speaker's peer, by name in the YANG model
+var maxPrefixFamilies = map[string]*api.Family{
+	"evpn": {Afi: api.Family_AFI_L2VPN, Safi: api.Family_SAFI_EVPN},
+}
+
+func (c *MaxPrefixConfig) action() string {
+	// NDK encodes the enum as e.g. ACTION_tear_down
+	return strings.ReplaceAll(strings.TrimPrefix(c.Action, "ACTION_"), "_", "-")
+}
+
+// level tells whether a number of received routes is within the limit (0), above the warning threshold (1) or
+// above the limit (2)
+func (c *MaxPrefixConfig) level(received uint64) int {
+	if received > uint64(c.MaxRoutes) {
+		return 2
+	} else if c.WarningThresholdPct > 0 && received > uint64(c.MaxRoutes)*uint64(c.WarningThresholdPct)/100 {
+		return 1
+	}
+	return 0
+}
+
+// prefixLimit returns the limit gobgp enforces itself, by tearing down the session
+func (b *BGPSpeaker) prefixLimit(family string) *api.PrefixLimit {
+	c, found := b.maxPrefix[family]
+	if !found || c.MaxRoutes == 0 || c.action() == "log" {
+		return nil
+	}
+	return &api.PrefixLimit{
+		Family:               maxPrefixFamilies[family],
+		MaxPrefixes:          c.MaxRoutes,
+		ShutdownThresholdPct: c.WarningThresholdPct,
+	}
+}
+
+// SyncMaxPrefix updates the prefix limits of the peer
+func (b *BGPSpeaker) SyncMaxPrefix() {
+	if b.s == nil {
+		return
+	}
+	if _, err := b.s.UpdatePeer(context.Background(), &api.UpdatePeerRequest{Peer: b.peer()}); err != nil {
+		b.logger.Error().Err(err).Msg("Can't update prefix limits of neighbour")
+	}
+}
+
+// CheckMaxPrefix logs the families that exceed a limit with the log action, which gobgp doesn't support
+func (b *BGPSpeaker) CheckMaxPrefix() {
+	if b.s == nil {
+		return
+	}
+	b.s.ListPeer(context.Background(), &api.ListPeerRequest{Address: b.Neighbour}, func(p *api.Peer) {
+		for family, c := range b.maxPrefix {
+			if c.MaxRoutes == 0 || c.action() != "log" {
+				continue
+			}
+			var received uint64
+			for _, afiSafi := range p.GetAfiSafis() {
+				if f := afiSafi.GetState().GetFamily(); f.GetAfi() == maxPrefixFamilies[family].Afi && f.GetSafi() == maxPrefixFamilies[family].Safi {
+					received = afiSafi.GetState().GetReceived()
+				}
+			}
+
+			level := c.level(received)
+			if level > b.prefixWarned[family] {
+				b.logger.Warn().Str("family", family).Uint64("received", received).Uint32("max", c.MaxRoutes).Bool("exceeded", level == 2).Msg("Maximum number of received routes reached")
+			}
+			b.prefixWarned[family] = level
+		}
+	})
+}
+
+// prefixLimitReached re-enables the peer after the restart interval, once gobgp tore down the session
+func (b *BGPSpeaker) prefixLimitReached() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s := b.s
+	for family, c := range b.maxPrefix {
+		if c.action() != "restart" || b.prefixRestart {
+			b.logger.Error().Str("family", family).Uint32("max", c.MaxRoutes).Msg("Maximum number of received routes exceeded, session torn down")
+			continue
+		}
+		interval := time.Duration(c.RestartInterval) * time.Second
+		b.logger.Error().Str("family", family).Uint32("max", c.MaxRoutes).Dur("restart-interval", interval).Msg("Maximum number of received routes exceeded, restarting session after interval")
+		b.prefixRestart = true
+		time.AfterFunc(interval, func() {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			b.prefixRestart = false
+			// Not if the speaker got restarted in the meantime
+			if b.s != s {
+				return
+			}
+			if err := b.s.EnablePeer(context.Background(), &api.EnablePeerRequest{Address: b.Neighbour}); err != nil {
+				b.logger.Error().Err(err).Msg("Can't restart session after prefix limit")
+			}
+		})
+	}
+}
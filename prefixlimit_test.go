@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMaxPrefixLevel(t *testing.T) {
+	c := MaxPrefixConfig{MaxRoutes: 100, WarningThresholdPct: 80}
+	for received, want := range map[uint64]int{0: 0, 80: 0, 81: 1, 100: 1, 101: 2} {
+		if got := c.level(received); got != want {
+			t.Errorf("level(%d) = %d, want %d", received, got, want)
+		}
+	}
+
+	// No warning threshold
+	c.WarningThresholdPct = 0
+	if got := c.level(100); got != 0 {
+		t.Errorf("level(100) without warning threshold = %d, want 0", got)
+	}
+}
+
+func TestPrefixLimit(t *testing.T) {
+	b := newTestSpeaker()
+	b.maxPrefix = map[string]MaxPrefixConfig{
+		"evpn": {MaxRoutes: 100, WarningThresholdPct: 80, Action: "ACTION_tear_down"},
+	}
+	want := &api.PrefixLimit{Family: maxPrefixFamilies["evpn"], MaxPrefixes: 100, ShutdownThresholdPct: 80}
+	if got := b.prefixLimit("evpn"); !proto.Equal(got, want) {
+		t.Errorf("prefixLimit() = %v, want %v", got, want)
+	}
+
+	for name, c := range map[string]MaxPrefixConfig{
+		// Enforced by CheckMaxPrefix instead
+		"log":       {MaxRoutes: 100, Action: "ACTION_log"},
+		"unlimited": {Action: "ACTION_restart"},
+	} {
+		b.maxPrefix["evpn"] = c
+		if got := b.prefixLimit("evpn"); got != nil {
+			t.Errorf("prefixLimit() with %s action = %v, want none", name, got)
+		}
+	}
+	if got := b.prefixLimit("ipv4-unicast"); got != nil {
+		t.Errorf("prefixLimit() of an unconfigured family = %v, want none", got)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// MacVrfInfo is the EVI, vxlan-interface and VNI of a mac-vrf or ip-vrf as found in the SR Linux state
+type MacVrfInfo struct {
+	Evi            string
+	VxlanInterface string
+	Vni            string
+}
+
+var (
+	errNoVxlanInterface = errors.New("no vxlan-interface")
+	errUnresolved       = errors.New("not resolved yet")
+)
+
+// The resolved EVIs and VNIs are read again at resolveInterval, to pick up changes of the bgp-evpn instances and
+// vxlan-interfaces that no notification reports
+const resolveInterval = 30 * time.Second
+
+type resolution struct {
+	info MacVrfInfo
+	err  error
+}
+
+// MacVrfResolver looks up the EVI of network-instances and the VNI of their vxlan-interface.
+// NDK network-instance notifications only carry the type and oper-state, and NDK has no tunnel-interface
+// notifications, so these are read from the state with sr_cli. A single read covers all network-instances,
+// it runs in the background so the notification loop only ever sees the results
+type MacVrfResolver struct {
+	logger *zerolog.Logger
+
+	// Signals that the resolution of some mac-vrfs changed
+	Events chan struct{}
+
+	mu sync.Mutex
+	// bgp-instance by mac-vrf to resolve
+	wanted  map[string]string
+	results map[string]resolution
+	running bool
+	refresh chan struct{}
+}
+
+func NewMacVrfResolver(logger *zerolog.Logger) *MacVrfResolver {
+	return &MacVrfResolver{
+		logger:  logger,
+		Events:  make(chan struct{}, 1),
+		wanted:  make(map[string]string),
+		results: make(map[string]resolution),
+		refresh: make(chan struct{}, 1),
+	}
+}
+
+// Sync sets the mac-vrfs to resolve, the ones not resolved yet are read right away
+func (r *MacVrfResolver) Sync(wanted map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	missing := false
+	for vrf, bgpInstance := range wanted {
+		if r.wanted[vrf] != bgpInstance {
+			delete(r.results, vrf)
+		}
+		if _, found := r.results[vrf]; !found {
+			missing = true
+		}
+	}
+	for vrf := range r.results {
+		if _, found := wanted[vrf]; !found {
+			delete(r.results, vrf)
+		}
+	}
+	r.wanted = wanted
+
+	if len(wanted) > 0 && !r.running {
+		r.running = true
+		go r.run()
+	}
+	if missing {
+		r.Refresh()
+	}
+}
+
+// Refresh reads the state again soon, e.g. after a network-instance or vxlan-interface changed
+func (r *MacVrfResolver) Refresh() {
+	select {
+	case r.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Lookup returns what was resolved for a mac-vrf, errUnresolved until it was read
+func (r *MacVrfResolver) Lookup(vrf string) (MacVrfInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if res, found := r.results[vrf]; found {
+		return res.info, res.err
+	}
+	return MacVrfInfo{}, errUnresolved
+}
+
+// UsesInterface tells whether a resolved mac-vrf uses the given vxlan-interface
+func (r *MacVrfResolver) UsesInterface(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, res := range r.results {
+		if res.info.VxlanInterface == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *MacVrfResolver) run() {
+	ticker := time.NewTicker(resolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.refresh:
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		wanted := r.wanted
+		r.mu.Unlock()
+		if len(wanted) == 0 {
+			continue
+		}
+
+		results, err := resolveAll(wanted)
+		if err != nil {
+			r.logger.Warn().Err(err).Msg("Can't resolve EVI and VNI of network-instances")
+			continue
+		}
+		if r.update(wanted, results) {
+			select {
+			case r.Events <- struct{}{}:
+			default:
+				// An event is pending already, it covers this change too
+			}
+		}
+	}
+}
+
+// update stores the results of a read for the given wanted mac-vrfs, and tells whether any changed
+func (r *MacVrfResolver) update(wanted map[string]string, results map[string]resolution) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := false
+	for vrf, res := range results {
+		if bgpInstance, found := r.wanted[vrf]; !found || bgpInstance != wanted[vrf] {
+			// Synced meanwhile, the next read resolves it
+			continue
+		}
+		if old, found := r.results[vrf]; found && reflect.DeepEqual(old, res) {
+			continue
+		}
+		r.results[vrf] = res
+		changed = true
+		r.logger.Info().Err(res.err).Str("vrf", vrf).Str("evi", res.info.Evi).Str("vxlan-interface", res.info.VxlanInterface).Str("vni", res.info.Vni).Msg("Resolved EVI and VNI of network-instance")
+	}
+	return changed
+}
+
+// resolveAll reads the bgp-evpn instances of all network-instances and the ingress VNI of all vxlan-interfaces
+func resolveAll(wanted map[string]string) (map[string]resolution, error) {
+	evpn, err := srCliState("network-instance * protocols bgp-evpn")
+	if err != nil {
+		return nil, err
+	}
+	tunnels, err := srCliState("tunnel-interface * vxlan-interface * ingress")
+	if err != nil {
+		return nil, err
+	}
+	return resolveState(wanted, evpn, tunnels), nil
+}
+
+// resolveState resolves the wanted mac-vrfs from the state of the bgp-evpn instances and tunnel-interfaces
+func resolveState(wanted map[string]string, evpn interface{}, tunnels interface{}) map[string]resolution {
+	// vxlan-interfaces are named <tunnel-interface>.<index>, e.g. vxlan1.210
+	vnis := make(map[string]string)
+	for _, tunnel := range jsonList(tunnels, "tunnel-interface") {
+		name, _ := jsonLeaf(tunnel, "name")
+		for _, vxlanIntf := range jsonList(tunnel, "vxlan-interface") {
+			index, _ := jsonLeaf(vxlanIntf, "index")
+			if vni, found := jsonLeaf(vxlanIntf, "ingress", "vni"); found {
+				vnis[name+"."+index] = vni
+			}
+		}
+	}
+
+	results := make(map[string]resolution)
+	for vrf, bgpInstance := range wanted {
+		results[vrf] = resolution{err: fmt.Errorf("no bgp-evpn bgp-instance %s", bgpInstance)}
+	}
+	for _, ni := range jsonList(evpn, "network-instance") {
+		vrf, _ := jsonLeaf(ni, "name")
+		bgpInstance, found := wanted[vrf]
+		if !found {
+			continue
+		}
+		for _, instance := range jsonList(ni, "protocols", "bgp-evpn", "bgp-instance") {
+			if id, _ := jsonLeaf(instance, "id"); id == bgpInstance {
+				results[vrf] = resolveInstance(instance, vnis)
+			}
+		}
+	}
+	return results
+}
+
+func resolveInstance(instance map[string]interface{}, vnis map[string]string) resolution {
+	var info MacVrfInfo
+	evi, found := jsonLeaf(instance, "evi")
+	if !found {
+		return resolution{err: errors.New("no evi")}
+	}
+	info.Evi = evi
+
+	vxlanIntf, found := jsonLeaf(instance, "vxlan-interface")
+	if !found {
+		return resolution{info: info, err: errNoVxlanInterface}
+	}
+	info.VxlanInterface = vxlanIntf
+	vni, found := vnis[vxlanIntf]
+	if !found {
+		return resolution{info: info, err: fmt.Errorf("no ingress vni for vxlan-interface %s", vxlanIntf)}
+	}
+	info.Vni = vni
+	return resolution{info: info}
+}
+
+func srCliState(path string) (interface{}, error) {
+	out, err := exec.Command("sr_cli", "info from state "+path+" | as json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("sr_cli state of %s: %v", path, err)
+	}
+
+	var state interface{}
+	if err := json.Unmarshal(out, &state); err != nil {
+		return nil, fmt.Errorf("sr_cli state of %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// jsonMember returns the member of a JSON object with the given name. sr_cli prefixes the name with its YANG
+// module where the module changes, e.g. srl_nokia-bgp-evpn:bgp-instance
+func jsonMember(node interface{}, name string) (interface{}, bool) {
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if v, found := obj[name]; found {
+		return v, true
+	}
+	for key, v := range obj {
+		if strings.HasSuffix(key, ":"+name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// jsonPath returns the node at the given path of member names
+func jsonPath(node interface{}, path ...string) (interface{}, bool) {
+	for _, name := range path {
+		child, found := jsonMember(node, name)
+		if !found {
+			return nil, false
+		}
+		node = child
+	}
+	return node, true
+}
+
+// jsonList returns the entries of the list at the given path
+func jsonList(node interface{}, path ...string) []map[string]interface{} {
+	list, _ := jsonPath(node, path...)
+	items, _ := list.([]interface{})
+	var entries []map[string]interface{}
+	for _, item := range items {
+		if entry, ok := item.(map[string]interface{}); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// jsonLeaf returns the value of the leaf at the given path, numbers as integers
+func jsonLeaf(node interface{}, path ...string) (string, bool) {
+	leaf, _ := jsonPath(node, path...)
+	switch v := leaf.(type) {
+	case string:
+		return v, true
+	case float64:
+		return fmt.Sprintf("%d", uint32(v)), true
+	}
+	return "", false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// As sr_cli reports the state, with module prefixes where the YANG module changes
+const (
+	testEvpnState = `{
+  "srl_nokia-network-instance:network-instance": [
+    {
+      "name": "mac-vrf-1",
+      "protocols": {
+        "srl_nokia-bgp-evpn:bgp-evpn": {
+          "bgp-instance": [
+            {"id": 2, "evi": 20, "vxlan-interface": "vxlan1.20"},
+            {"id": 1, "evi": 10, "vxlan-interface": "vxlan1.10"}
+          ]
+        }
+      }
+    },
+    {
+      "name": "mac-vrf-2",
+      "protocols": {"srl_nokia-bgp-evpn:bgp-evpn": {"bgp-instance": [{"id": 1, "evi": 30}]}}
+    },
+    {
+      "name": "mac-vrf-3",
+      "protocols": {"srl_nokia-bgp-evpn:bgp-evpn": {"bgp-instance": [{"id": 1, "evi": 40, "vxlan-interface": "vxlan1.40"}]}}
+    },
+    {
+      "name": "mac-vrf-4",
+      "protocols": {"srl_nokia-bgp-evpn:bgp-evpn": {"bgp-instance": [{"id": 1, "evi": 50, "vxlan-interface": "vxlan1.50"}]}}
+    }
+  ]
+}`
+	testTunnelState = `{
+  "srl_nokia-tunnel-interfaces:tunnel-interface": [
+    {
+      "name": "vxlan1",
+      "vxlan-interface": [
+        {"index": 10, "ingress": {"vni": 1010}},
+        {"index": 20, "ingress": {"vni": 1020}},
+        {"index": 40}
+      ]
+    }
+  ]
+}`
+)
+
+func TestResolveState(t *testing.T) {
+	var evpn, tunnels interface{}
+	if err := json.Unmarshal([]byte(testEvpnState), &evpn); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(testTunnelState), &tunnels); err != nil {
+		t.Fatal(err)
+	}
+
+	got := resolveState(map[string]string{
+		"mac-vrf-1": "1",
+		"mac-vrf-2": "1",
+		"mac-vrf-3": "1",
+		"mac-vrf-4": "2",
+		"mac-vrf-5": "1",
+	}, evpn, tunnels)
+	want := map[string]resolution{
+		"mac-vrf-1": {info: MacVrfInfo{Evi: "10", VxlanInterface: "vxlan1.10", Vni: "1010"}},
+		"mac-vrf-2": {info: MacVrfInfo{Evi: "30"}, err: errNoVxlanInterface},
+		"mac-vrf-3": {info: MacVrfInfo{Evi: "40", VxlanInterface: "vxlan1.40"}, err: errors.New("no ingress vni for vxlan-interface vxlan1.40")},
+		"mac-vrf-4": {err: errors.New("no bgp-evpn bgp-instance 2")},
+		"mac-vrf-5": {err: errors.New("no bgp-evpn bgp-instance 1")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("resolveState() resolved %d mac-vrfs, want %d", len(got), len(want))
+	}
+	for vrf, w := range want {
+		g := got[vrf]
+		if g.info != w.info || fmt.Sprint(g.err) != fmt.Sprint(w.err) {
+			t.Errorf("resolveState()[%s] = %+v, want %+v", vrf, g, w)
+		}
+	}
+}
+
+func TestResolverUpdate(t *testing.T) {
+	logger := zerolog.Nop()
+	r := NewMacVrfResolver(&logger)
+	// Not through Sync, which starts reading the state
+	r.wanted = map[string]string{"mac-vrf-1": "1", "mac-vrf-2": "1"}
+
+	if _, err := r.Lookup("mac-vrf-1"); err != errUnresolved {
+		t.Errorf("Lookup() before a read error = %v, want %v", err, errUnresolved)
+	}
+
+	res := resolution{info: MacVrfInfo{Evi: "10", VxlanInterface: "vxlan1.10", Vni: "1010"}}
+	if !r.update(r.wanted, map[string]resolution{"mac-vrf-1": res}) {
+		t.Errorf("update() of a new resolution reported no change")
+	}
+	if info, err := r.Lookup("mac-vrf-1"); err != nil || !reflect.DeepEqual(info, res.info) {
+		t.Errorf("Lookup() = %+v, %v, want %+v", info, err, res.info)
+	}
+	if r.update(r.wanted, map[string]resolution{"mac-vrf-1": res}) {
+		t.Errorf("update() of the same resolution reported a change")
+	}
+
+	// A read for a bgp-instance that changed meanwhile is dropped
+	stale := map[string]string{"mac-vrf-2": "2"}
+	if r.update(stale, map[string]resolution{"mac-vrf-2": res}) {
+		t.Errorf("update() of a stale read reported a change")
+	}
+	if _, err := r.Lookup("mac-vrf-2"); err != errUnresolved {
+		t.Errorf("Lookup() after a stale read error = %v, want %v", err, errUnresolved)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	"github.com/osrg/gobgp/v3/pkg/packet/bgp"
+)
+
+const ribInterval = 10 * time.Second
+
+// RibRoute is an EVPN route of the BGP speaker, as published in the rib state of the agent
+type RibRoute struct {
+	Prefix             string   `json:"prefix"`
+	Origin             string   `json:"origin"`
+	RouteType          string   `json:"route_type"`
+	RouteDistinguisher string   `json:"route_distinguisher"`
+	EthernetTag        uint32   `json:"ethernet_tag_id"`
+	MacAddress         string   `json:"mac_address,omitempty"`
+	IpAddress          string   `json:"ip_address,omitempty"`
+	NextHop            string   `json:"next_hop,omitempty"`
+	Label              uint32   `json:"label"`
+	RouteTargets       []string `json:"route_target,omitempty"`
+	LastModified       string   `json:"last_modified"`
+	Best               bool     `json:"best_route"`
+	Valid              bool     `json:"valid_route"`
+
+	evis []uint32
+}
+
+// isOriginated tells apart the paths added by this speaker from the ones received from the peer
+func isOriginated(path *api.Path) bool {
+	return path.NeighborIp == "" || path.NeighborIp == "<nil>"
+}
+
+func newRibRoute(path *api.Path) (*RibRoute, error) {
+	nlri, err := apiutil.UnmarshalNLRI(bgp.RF_EVPN, path.Nlri)
+	if err != nil {
+		return nil, err
+	}
+	evpn, ok := nlri.(*bgp.EVPNNLRI)
+	if !ok {
+		return nil, fmt.Errorf("not an EVPN route: %s", nlri)
+	}
+
+	r := &RibRoute{
+		Prefix:       evpn.String(),
+		Origin:       "received",
+		LastModified: path.GetAge().AsTime().UTC().Format(time.RFC3339),
+		Best:         path.Best,
+		Valid:        !path.IsNexthopInvalid && !path.Filtered,
+	}
+	if isOriginated(path) {
+		r.Origin = "originated"
+	}
+
+	switch route := evpn.RouteTypeData.(type) {
+	case *bgp.EVPNEthernetAutoDiscoveryRoute:
+		r.RouteType = "ethernet-ad"
+		r.RouteDistinguisher = route.RD.String()
+		r.EthernetTag = route.ETag
+		r.Label = route.Label
+	case *bgp.EVPNMacIPAdvertisementRoute:
+		r.RouteType = "mac-ip"
+		r.RouteDistinguisher = route.RD.String()
+		r.EthernetTag = route.ETag
+		r.MacAddress = route.MacAddress.String()
+		if len(route.IPAddress) > 0 && !route.IPAddress.IsUnspecified() {
+			r.IpAddress = route.IPAddress.String()
+		}
+		if len(route.Labels) > 0 {
+			r.Label = route.Labels[0]
+		}
+	case *bgp.EVPNMulticastEthernetTagRoute:
+		r.RouteType = "imet"
+		r.RouteDistinguisher = route.RD.String()
+		r.EthernetTag = route.ETag
+		r.IpAddress = route.IPAddress.String()
+	case *bgp.EVPNEthernetSegmentRoute:
+		r.RouteType = "ethernet-segment"
+		r.RouteDistinguisher = route.RD.String()
+		r.IpAddress = route.IPAddress.String()
+	case *bgp.EVPNIPPrefixRoute:
+		r.RouteType = "ip-prefix"
+		r.RouteDistinguisher = route.RD.String()
+		r.EthernetTag = route.ETag
+		r.IpAddress = fmt.Sprintf("%s/%d", route.IPPrefix, route.IPPrefixLength)
+		r.Label = route.Label
+	default:
+		return nil, fmt.Errorf("unsupported EVPN route type %d", evpn.RouteType)
+	}
+
+	for _, a := range path.Pattrs {
+		attr, err := apiutil.UnmarshalAttribute(a)
+		if err != nil {
+			continue
+		}
+		switch attr := attr.(type) {
+		case *bgp.PathAttributeNextHop:
+			r.NextHop = attr.Value.String()
+		case *bgp.PathAttributeMpReachNLRI:
+			r.NextHop = attr.Nexthop.String()
+		case *bgp.PathAttributePmsiTunnel:
+			r.Label = attr.Label
+		case *bgp.PathAttributeExtendedCommunities:
+			for _, ec := range attr.Value {
+				// The ES-Import route-target of ES routes has the same sub-type, but doesn't identify an EVI
+				if ecType, subType := ec.GetTypes(); subType != bgp.EC_SUBTYPE_ROUTE_TARGET || ecType == bgp.EC_TYPE_EVPN {
+					continue
+				}
+				r.RouteTargets = append(r.RouteTargets, ec.String())
+				switch rt := ec.(type) {
+				case *bgp.TwoOctetAsSpecificExtended:
+					r.evis = append(r.evis, rt.LocalAdmin)
+				case *bgp.FourOctetAsSpecificExtended:
+					r.evis = append(r.evis, uint32(rt.LocalAdmin))
+				case *bgp.IPv4AddressSpecificExtended:
+					r.evis = append(r.evis, uint32(rt.LocalAdmin))
+				}
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// GetRibRoutes groups the EVPN RIB per mac-vrf, matching the route-target of each route with the EVI
+func (b *BGPSpeaker) GetRibRoutes() map[string][]*RibRoute {
+	rib := make(map[string][]*RibRoute)
+	vrfs := make(map[uint32][]string)
+	for vrf, vrfConfig := range b.vniConfigs {
+		rib[vrf] = []*RibRoute{}
+		evi := getUint32FromJson(vrfConfig.Evi)
+		vrfs[evi] = append(vrfs[evi], vrf)
+	}
+	if b.s == nil {
+		return rib
+	}
+
+	for _, path := range b.GetRib() {
+		r, err := newRibRoute(path)
+		if err != nil {
+			b.logger.Debug().Err(err).Msg("Skipping path for rib state")
+			continue
+		}
+		// A route may carry the route-target of an EVI more than once
+		added := make(map[string]bool)
+		for _, evi := range r.evis {
+			for _, vrf := range vrfs[evi] {
+				if !added[vrf] {
+					added[vrf] = true
+					rib[vrf] = append(rib[vrf], r)
+				}
+			}
+		}
+	}
+	return rib
+}
+
+// SendRib reports the RIB and the duplicate MACs found in it to the agent, unless nothing changed since the last report
+func (b *BGPSpeaker) SendRib() {
+	rib := b.GetRibRoutes()
+	b.SendDuplicateMacs(b.findDuplicateMacs(rib))
+
+	str, err := json.Marshal(rib)
+	if err != nil {
+		b.logger.Error().Err(err).Msg("Can't encode rib")
+		return
+	}
+	if bytes.Equal(str, b.lastRib) {
+		return
+	}
+	b.lastRib = str
+	b.SendToParentProcess("rib", json.RawMessage(str))
+}
+
+// publishRib updates the rib state in telemetry, in the network-instance of the agent. Only the routes that changed
+// since the last report are published, in a single call, and the ones that are gone are removed
+func (a *Agent) publishRib(netInst string, rib map[string][]*RibRoute) {
+	published := make(map[string]string)
+	for vrf, routes := range rib {
+		vrfPath := fmt.Sprintf("%s.rib.mac_vrf{.name==\"%s\"}", agentStatePath(netInst), vrf)
+		str, _ := json.Marshal(map[string]string{"name": vrf})
+		published[vrfPath] = string(str)
+
+		for _, r := range routes {
+			routePath := fmt.Sprintf("%s.route{.prefix==\"%s\",.origin==\"%s\"}", vrfPath, r.Prefix, r.Origin)
+			str, err := json.Marshal(r)
+			if err != nil {
+				a.logger.Error().Err(err).Str("path", routePath).Msg("Can't encode telemetry")
+				continue
+			}
+			published[routePath] = string(str)
+		}
+	}
+
+	changed := make(map[string]string)
+	for jsPath, data := range published {
+		if a.ribState[jsPath] != data {
+			changed[jsPath] = data
+		}
+	}
+	var deleted []string
+	for jsPath := range a.ribState {
+		if _, found := published[jsPath]; !found {
+			deleted = append(deleted, jsPath)
+		}
+	}
+	// What failed is retried with the next report
+	if !a.updateTelemetryPaths(changed) {
+		for jsPath := range changed {
+			if data, found := a.ribState[jsPath]; found {
+				published[jsPath] = data
+			} else {
+				delete(published, jsPath)
+			}
+		}
+	}
+	if !a.deleteTelemetryPaths(deleted) {
+		for _, jsPath := range deleted {
+			published[jsPath] = a.ribState[jsPath]
+		}
+	}
+	a.ribState = published
+}
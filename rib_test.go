@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	apb "google.golang.org/protobuf/types/known/anypb"
+)
+
+// testTelemetry records the calls to the NDK telemetry service
+type testTelemetry struct {
+	ndk.SdkMgrTelemetryServiceClient
+	updates []*ndk.TelemetryUpdateRequest
+	deletes []*ndk.TelemetryDeleteRequest
+}
+
+func (t *testTelemetry) TelemetryAddOrUpdate(ctx context.Context, in *ndk.TelemetryUpdateRequest, opts ...grpc.CallOption) (*ndk.TelemetryUpdateResponse, error) {
+	t.updates = append(t.updates, in)
+	return &ndk.TelemetryUpdateResponse{Status: ndk.SdkMgrStatus_kSdkMgrSuccess}, nil
+}
+
+func (t *testTelemetry) TelemetryDelete(ctx context.Context, in *ndk.TelemetryDeleteRequest, opts ...grpc.CallOption) (*ndk.TelemetryDeleteResponse, error) {
+	t.deletes = append(t.deletes, in)
+	return &ndk.TelemetryDeleteResponse{Status: ndk.SdkMgrStatus_kSdkMgrSuccess}, nil
+}
+
+// updated returns the JS paths published by the update calls since the last one, and forgets the calls
+func (t *testTelemetry) updated() [][]string {
+	var calls [][]string
+	for _, req := range t.updates {
+		var paths []string
+		for _, info := range req.State {
+			paths = append(paths, info.Key.JsPath)
+		}
+		sort.Strings(paths)
+		calls = append(calls, paths)
+	}
+	t.updates = nil
+	return calls
+}
+
+// deleted returns the JS paths removed by the delete calls since the last one, and forgets the calls
+func (t *testTelemetry) deleted() [][]string {
+	var calls [][]string
+	for _, req := range t.deletes {
+		var paths []string
+		for _, key := range req.Key {
+			paths = append(paths, key.JsPath)
+		}
+		sort.Strings(paths)
+		calls = append(calls, paths)
+	}
+	t.deletes = nil
+	return calls
+}
+
+func testEvpnPath(t *testing.T, nlri proto.Message, nextHop string, neighbor string, attrs ...proto.Message) *api.Path {
+	n, err := apb.New(nlri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nh, _ := apb.New(&api.NextHopAttribute{NextHop: nextHop})
+	path := &api.Path{
+		Family:     &api.Family{Afi: api.Family_AFI_L2VPN, Safi: api.Family_SAFI_EVPN},
+		Nlri:       n,
+		Pattrs:     []*apb.Any{nh},
+		NeighborIp: neighbor,
+	}
+	for _, attr := range attrs {
+		a, err := apb.New(attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path.Pattrs = append(path.Pattrs, a)
+	}
+	return path
+}
+
+func TestNewRibRoute(t *testing.T) {
+	rd, _ := apb.New(&api.RouteDistinguisherIPAddress{Admin: "1.1.1.1", Assigned: 10})
+	rt, _ := apb.New(&api.TwoOctetAsSpecificExtended{IsTransitive: true, SubType: 2, Asn: 65000, LocalAdmin: 10})
+	encap, _ := apb.New(&api.EncapExtended{TunnelType: 8})
+	communities := &api.ExtendedCommunitiesAttribute{Communities: []*apb.Any{rt, encap}}
+
+	tests := []struct {
+		name string
+		path *api.Path
+		want RibRoute
+	}{
+		{
+			name: "originated IMET",
+			path: testEvpnPath(t, &api.EVPNInclusiveMulticastEthernetTagRoute{Rd: rd, IpAddress: "1.1.1.1"}, "1.1.1.1", "",
+				communities, &api.PmsiTunnelAttribute{Type: 6, Label: 100, Id: net.ParseIP("1.1.1.1").To4()}),
+			want: RibRoute{
+				Origin:             "originated",
+				Valid:              true,
+				RouteType:          "imet",
+				RouteDistinguisher: "1.1.1.1:10",
+				IpAddress:          "1.1.1.1",
+				NextHop:            "1.1.1.1",
+				Label:              100,
+				RouteTargets:       []string{"65000:10"},
+				evis:               []uint32{10},
+			},
+		},
+		{
+			name: "received MAC/IP",
+			path: testEvpnPath(t, &api.EVPNMACIPAdvertisementRoute{
+				Rd:          rd,
+				Esi:         &api.EthernetSegmentIdentifier{},
+				EthernetTag: 5,
+				MacAddress:  "00:00:00:00:00:01",
+				IpAddress:   "10.0.0.1",
+				Labels:      []uint32{100},
+			}, "2.2.2.2", "2.2.2.2", communities),
+			want: RibRoute{
+				Origin:             "received",
+				Valid:              true,
+				RouteType:          "mac-ip",
+				RouteDistinguisher: "1.1.1.1:10",
+				EthernetTag:        5,
+				MacAddress:         "00:00:00:00:00:01",
+				IpAddress:          "10.0.0.1",
+				NextHop:            "2.2.2.2",
+				Label:              100,
+				RouteTargets:       []string{"65000:10"},
+				evis:               []uint32{10},
+			},
+		},
+		{
+			name: "MAC only",
+			path: testEvpnPath(t, &api.EVPNMACIPAdvertisementRoute{
+				Rd:         rd,
+				Esi:        &api.EthernetSegmentIdentifier{},
+				MacAddress: "00:00:00:00:00:01",
+				Labels:     []uint32{100},
+			}, "1.1.1.1", ""),
+			want: RibRoute{
+				Origin:             "originated",
+				Valid:              true,
+				RouteType:          "mac-ip",
+				RouteDistinguisher: "1.1.1.1:10",
+				MacAddress:         "00:00:00:00:00:01",
+				NextHop:            "1.1.1.1",
+				Label:              100,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newRibRoute(tt.path)
+			if err != nil {
+				t.Fatalf("newRibRoute() error = %v", err)
+			}
+			// The prefix and age are gobgp's rendering
+			got.Prefix, got.LastModified = "", ""
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("newRibRoute() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishRib(t *testing.T) {
+	logger := zerolog.Nop()
+	telemetry := &testTelemetry{}
+	a := &Agent{logger: &logger, telemetryCtx: context.Background(), TelemetryServiceClient: telemetry, telemetry: make(map[string]string)}
+
+	route := func(prefix string, nextHop string) *RibRoute {
+		return &RibRoute{Prefix: prefix, Origin: "received", RouteType: "mac-ip", NextHop: nextHop}
+	}
+	vrfPath := `.network_instance{.name=="default"}.protocols.static_vxlan_agent.rib.mac_vrf{.name=="mac-vrf-1"}`
+	routePath := func(prefix string) string {
+		return vrfPath + `.route{.prefix=="` + prefix + `",.origin=="received"}`
+	}
+
+	a.publishRib("default", map[string][]*RibRoute{"mac-vrf-1": {route("a", "1.1.1.1"), route("b", "1.1.1.1")}})
+	if got, want := telemetry.updated(), [][]string{{vrfPath, routePath("a"), routePath("b")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first report published %v, want %v", got, want)
+	}
+
+	// Only what changed is published again
+	a.publishRib("default", map[string][]*RibRoute{"mac-vrf-1": {route("a", "1.1.1.1"), route("b", "2.2.2.2"), route("c", "1.1.1.1")}})
+	if got, want := telemetry.updated(), [][]string{{routePath("b"), routePath("c")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second report published %v, want %v", got, want)
+	}
+	if got := telemetry.deleted(); len(got) != 0 {
+		t.Errorf("second report deleted %v", got)
+	}
+
+	a.publishRib("default", map[string][]*RibRoute{"mac-vrf-1": {route("c", "1.1.1.1")}})
+	if got := telemetry.updated(); len(got) != 0 {
+		t.Errorf("third report published %v", got)
+	}
+	if got, want := telemetry.deleted(), [][]string{{routePath("a"), routePath("b")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("third report deleted %v, want %v", got, want)
+	}
+
+	// The rib of an agent in another network-instance replaces it
+	a.publishRib("mgmt", map[string][]*RibRoute{})
+	if got, want := telemetry.deleted(), [][]string{{vrfPath, routePath("c")}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("network-instance change deleted %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	"github.com/osrg/gobgp/v3/pkg/packet/bgp"
+	"google.golang.org/protobuf/proto"
+	apb "google.golang.org/protobuf/types/known/anypb"
+)
+
+// Routes of an Ethernet Segment aren't specific to a mac-vrf, they are counted under the default network-instance
+const esRoutesVrf = "default"
+
+// EthernetSegment groups static VTEPs that multi-home the same legacy devices
+type EthernetSegment struct {
+	Esi             string   `json:"esi"`
+	MultiHomingMode string   `json:"multi_homing_mode"`
+	Vteps           []string `json:"vteps"`
+}
+
+func (es *EthernetSegment) singleActive() bool {
+	// NDK encodes the enum as e.g. MULTI_HOMING_MODE_single_active
+	return strings.HasSuffix(es.MultiHomingMode, "single_active") || es.MultiHomingMode == "single-active"
+}
+
+// parseEsi converts the 10 byte ESI, e.g. 01:00:00:00:00:00:00:00:00:01, to its type and value
+func parseEsi(esi string) (*api.EthernetSegmentIdentifier, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(esi, ":", ""))
+	if err != nil || len(b) != 10 {
+		return nil, fmt.Errorf("invalid ESI %q", esi)
+	}
+	return &api.EthernetSegmentIdentifier{Type: uint32(b[0]), Value: b[1:]}, nil
+}
+
+// VtepFlooding controls the BUM replication towards a static VTEP
+type VtepFlooding struct {
+	// Leave the VTEP out of the flood lists, it then only receives known-unicast traffic
+	SuppressImet     bool   `json:"suppress_imet"`
+	PmsiTunnelType   string `json:"pmsi_tunnel_type"`
+	LeafInfoRequired bool   `json:"leaf_information_required"`
+	MulticastGroup   string `json:"multicast_group,omitempty"`
+}
+
+// pmsiTunnelTypes maps the YANG enum to the PMSI tunnel types of RFC 6514
+var pmsiTunnelTypes = map[string]uint32{
+	"no-tunnel-info":      0,
+	"pim-ssm":             3,
+	"pim-sm":              4,
+	"bidir-pim":           5,
+	"ingress-replication": 6,
+}
+
+// pmsiTunnel returns the PMSI tunnel type, flags and tunnel identifier of a VTEP
+func (f *VtepFlooding) pmsiTunnel(vtep string) (uint32, uint32, []byte) {
+	// NDK encodes the enum as e.g. PMSI_TUNNEL_TYPE_ingress_replication
+	name := strings.ReplaceAll(strings.TrimPrefix(f.PmsiTunnelType, "PMSI_TUNNEL_TYPE_"), "_", "-")
+	tunnelType, found := pmsiTunnelTypes[name]
+	if !found {
+		tunnelType = pmsiTunnelTypes["ingress-replication"]
+	}
+
+	var flags uint32
+	if f.LeafInfoRequired {
+		flags = 0x01
+	}
+
+	id := []byte(net.ParseIP(vtep).To4())
+	switch tunnelType {
+	case 0:
+		id = nil
+	case 3, 4, 5:
+		// <Sender Address, P-Multicast Group>
+		id = append(id, net.ParseIP(f.MulticastGroup).To4()...)
+	}
+	return tunnelType, flags, id
+}
+
+// originatedPath is a path the speaker advertises on behalf of a static VTEP
+type originatedPath struct {
+	vrf  string
+	path *api.Path
+}
+
+// pathKey identifies a path by its NLRI, which includes the RD
+func pathKey(path *api.Path) string {
+	nlri, err := apiutil.UnmarshalNLRI(bgp.RF_EVPN, path.Nlri)
+	if err != nil {
+		return ""
+	}
+	return nlri.String()
+}
+
+// originator returns the IP that originates the routes of a VTEP in a VRF, it is the Originating Router's IP of
+// the IMET route and the administrator of the route distinguisher of all routes of the EVI.
+// By default the VTEP originates its own routes. With originator router-id the agent originates them,
+// so the VRF can have only one VTEP as the route distinguishers would otherwise collide
+func (v *VniConfig) originator(vtep string, routerId string) string {
+	if strings.TrimPrefix(v.Originator, "ORIGINATOR_") == "router_id" {
+		return routerId
+	}
+	return vtep
+}
+
+// ethernetSegmentOf returns the ESI of a VTEP, all zero when it is single-homed
+func (b *BGPSpeaker) ethernetSegmentOf(vtep string) (*api.EthernetSegmentIdentifier, bool) {
+	for name, es := range b.ethernetSegments {
+		for _, v := range es.Vteps {
+			if v != vtep {
+				continue
+			}
+			esi, err := parseEsi(es.Esi)
+			if err != nil {
+				b.logger.Error().Err(err).Str("ethernet-segment", name).Msg("Ignoring ethernet-segment")
+				break
+			}
+			return esi, true
+		}
+	}
+	return &api.EthernetSegmentIdentifier{}, false
+}
+
+// originatedPaths builds the paths to advertise for the given VRFs, by VRF, and the paths of the ethernet segments.
+// A VRF without config gets no paths, so its routes get withdrawn
+func (b *BGPSpeaker) originatedPaths(vrfs map[string]bool) map[string]map[string]*originatedPath {
+	paths := make(map[string]map[string]*originatedPath)
+	for vrf := range vrfs {
+		paths[vrf] = make(map[string]*originatedPath)
+		if vrfConfig, found := b.vniConfigs[vrf]; found {
+			b.addVrfPaths(paths[vrf], vrf, &vrfConfig)
+		}
+	}
+	// These depend on the EVIs of all mac-vrfs, but there are only a few per VTEP
+	paths[esRoutesVrf] = b.ethernetSegmentPaths()
+	return paths
+}
+
+func addPath(paths map[string]*originatedPath, vrf string, path *api.Path) {
+	if key := pathKey(path); key != "" {
+		paths[key] = &originatedPath{vrf: vrf, path: path}
+	}
+}
+
+// addVrfPaths adds the paths of the static VTEPs of a mac-vrf or ip-vrf
+func (b *BGPSpeaker) addVrfPaths(paths map[string]*originatedPath, vrf string, vrfConfig *VniConfig) {
+	add := func(path *api.Path) {
+		addPath(paths, vrf, path)
+	}
+	evi, vni := vrfConfig.eviVni()
+
+	if vrfConfig.Type == "ip-vrf" {
+		for address, vtep := range vrfConfig.Vteps {
+			originator := vrfConfig.originator(address, b.RouterId)
+			for _, prefix := range vtep.IpPrefixes {
+				if path := b.ipPrefixPath(address, originator, vni, evi, vtep.RouterMac, prefix); path != nil {
+					add(path)
+				}
+			}
+		}
+		return
+	}
+
+	for address, vtep := range vrfConfig.Vteps {
+		esi, multiHomed := b.ethernetSegmentOf(address)
+		communities := b.communityAttrs(&vtep.Communities)
+		originator := vrfConfig.originator(address, b.RouterId)
+
+		if !vtep.Flooding.SuppressImet {
+			add(b.multicastPath(address, originator, vni, evi, 0, &vtep.Flooding, communities))
+		}
+		// Learned MACs may move, so they are never sticky. Configured MACs are added after them and take precedence
+		for _, mac := range vtep.DiscoveredMacs {
+			add(b.macIpPath(address, originator, vni, evi, 0, esi, mac, "", false, communities))
+		}
+		for _, mac := range vtep.StaticMacs {
+			add(b.macIpPath(address, originator, vni, evi, 0, esi, mac, "", vrfConfig.StickyMacs, communities))
+		}
+		// A bound MAC is also advertised on its own, besides once per IP for proxy-ARP/ND
+		for mac, ips := range vtep.MacIps {
+			add(b.macIpPath(address, originator, vni, evi, 0, esi, mac, "", vrfConfig.StickyMacs, communities))
+			for _, ip := range ips {
+				add(b.macIpPath(address, originator, vni, evi, 0, esi, mac, ip, vrfConfig.StickyMacs, communities))
+			}
+		}
+		if multiHomed {
+			add(b.adPerEviPath(address, originator, vni, evi, 0, esi))
+		}
+
+		// VLAN-aware bundle, each ethernet tag of the VTEP is a broadcast domain with its own VNI
+		for id, tag := range vtep.EthernetTags {
+			etag, tagVni := getUint32FromJson(id), getUint32FromJson(tag.Vni)
+			if !vtep.Flooding.SuppressImet {
+				add(b.multicastPath(address, originator, tagVni, evi, etag, &vtep.Flooding, communities))
+			}
+			for _, mac := range tag.StaticMacs {
+				add(b.macIpPath(address, originator, tagVni, evi, etag, esi, mac, "", vrfConfig.StickyMacs, communities))
+			}
+			if multiHomed {
+				add(b.adPerEviPath(address, originator, tagVni, evi, etag, esi))
+			}
+		}
+	}
+}
+
+// ethernetSegmentPaths builds the A-D per ES and ES routes of the VTEPs of the ethernet segments
+func (b *BGPSpeaker) ethernetSegmentPaths() map[string]*originatedPath {
+	paths := make(map[string]*originatedPath)
+
+	// EVIs in which each VTEP is advertised, for the A-D per ES routes
+	evis := make(map[string][]uint32)
+	for _, vrfConfig := range b.vniConfigs {
+		if vrfConfig.Type == "ip-vrf" {
+			continue
+		}
+		evi, _ := vrfConfig.eviVni()
+		for address := range vrfConfig.Vteps {
+			evis[address] = append(evis[address], evi)
+		}
+	}
+
+	for name, es := range b.ethernetSegments {
+		esi, err := parseEsi(es.Esi)
+		if err != nil {
+			continue
+		}
+		for _, vtep := range es.Vteps {
+			// Only VTEPs advertised in some mac-vrf, i.e. configured and reachable, join the segment
+			if len(evis[vtep]) == 0 {
+				b.logger.Debug().Str("ethernet-segment", name).Str("vtep", vtep).Msg("VTEP not advertised in any mac-vrf")
+				continue
+			}
+			sort.Slice(evis[vtep], func(i, j int) bool { return evis[vtep][i] < evis[vtep][j] })
+			addPath(paths, esRoutesVrf, b.adPerEsPath(vtep, esi, es.singleActive(), evis[vtep]))
+			addPath(paths, esRoutesVrf, b.ethernetSegmentPath(vtep, esi))
+		}
+	}
+	return paths
+}
+
+// eviVni returns the EVI and VNI of a VRF as numbers
+func (v *VniConfig) eviVni() (uint32, uint32) {
+	evi, _ := strconv.ParseUint(v.Evi, 10, 32)
+	vni, _ := strconv.ParseUint(v.Vni, 10, 32)
+	return uint32(evi), uint32(vni)
+}
+
+func routeDistinguisher(vtep string, assigned uint32) *apb.Any {
+	rd, _ := apb.New(&api.RouteDistinguisherIPAddress{
+		Admin:    vtep,
+		Assigned: assigned,
+	})
+	return rd
+}
+
+func (b *BGPSpeaker) routeTarget(evi uint32) *apb.Any {
+	rt, _ := apb.New(&api.TwoOctetAsSpecificExtended{
+		IsTransitive: true,
+		SubType:      2, // EC_SUBTYPE_ROUTE_TARGET
+		Asn:          uint32(b.LocalAS),
+		LocalAdmin:   evi,
+	})
+	return rt
+}
+
+func vxlanEncap() *apb.Any {
+	encap, _ := apb.New(&api.EncapExtended{
+		TunnelType: 8, // TUNNEL_TYPE_VXLAN
+	})
+	return encap
+}
+
+// newEvpnPath builds a path with the VTEP as next-hop, the given extended communities and extra attributes
+func newEvpnPath(nlri proto.Message, vtep string, communities []*apb.Any, attrs ...*apb.Any) *api.Path {
+	n, _ := apb.New(nlri)
+
+	origin, _ := apb.New(&api.OriginAttribute{
+		Origin: 0,
+	})
+
+	nextHop, _ := apb.New(&api.NextHopAttribute{
+		NextHop: vtep,
+	})
+
+	extComms, _ := apb.New(&api.ExtendedCommunitiesAttribute{
+		Communities: communities,
+	})
+
+	return &api.Path{
+		Family: &api.Family{Afi: api.Family_AFI_L2VPN, Safi: api.Family_SAFI_EVPN},
+		Nlri:   n,
+		Pattrs: append([]*apb.Any{origin, nextHop, extComms}, attrs...),
+	}
+}
+
+// multicastPath is the IMET route (type 3) of a VTEP, which adds it to the flood lists for BUM traffic
+// Whatever the originator, the VTEP is the next-hop and the PMSI tunnel endpoint
+func (b *BGPSpeaker) multicastPath(vtep string, originator string, vni uint32, evi uint32, etag uint32, flooding *VtepFlooding, communities *communityAttrs) *api.Path {
+	tunnelType, flags, id := flooding.pmsiTunnel(vtep)
+	pmsi, _ := apb.New(&api.PmsiTunnelAttribute{
+		Flags: flags,
+		Type:  tunnelType,
+		Label: vni,
+		Id:    id,
+	})
+
+	path := newEvpnPath(&api.EVPNInclusiveMulticastEthernetTagRoute{
+		Rd:          routeDistinguisher(originator, evi),
+		IpAddress:   originator,
+		EthernetTag: etag,
+	}, vtep, append([]*apb.Any{b.routeTarget(evi), vxlanEncap()}, communities.extended...), pmsi)
+	return b.withCommunities(path, communities, "")
+}
+
+// macIpPath is the MAC/IP route (type 2) of a static MAC behind a VTEP, ip is empty for a MAC only route.
+// The MAC Mobility extended community tells the fabric whether the MAC is sticky, i.e. must not move
+func (b *BGPSpeaker) macIpPath(vtep string, originator string, vni uint32, evi uint32, etag uint32, esi *api.EthernetSegmentIdentifier, mac string, ip string, sticky bool, communities *communityAttrs) *api.Path {
+	localPref, _ := apb.New(&api.LocalPrefAttribute{
+		LocalPref: b.LocalPreference,
+	})
+
+	mobility, _ := apb.New(&api.MacMobilityExtended{
+		IsSticky:    sticky,
+		SequenceNum: 0,
+	})
+
+	path := newEvpnPath(&api.EVPNMACIPAdvertisementRoute{
+		Rd:          routeDistinguisher(originator, evi),
+		Esi:         esi,
+		EthernetTag: etag,
+		MacAddress:  mac,
+		IpAddress:   ip,
+		Labels:      []uint32{vni},
+	}, vtep, append([]*apb.Any{b.routeTarget(evi), vxlanEncap(), mobility}, communities.extended...), localPref)
+	return b.withCommunities(path, communities, mac)
+}
+
+// adPerEviPath is the A-D per EVI route (type 1) of a multi-homed VTEP, used for aliasing
+func (b *BGPSpeaker) adPerEviPath(vtep string, originator string, vni uint32, evi uint32, etag uint32, esi *api.EthernetSegmentIdentifier) *api.Path {
+	return newEvpnPath(&api.EVPNEthernetAutoDiscoveryRoute{
+		Rd:          routeDistinguisher(originator, evi),
+		Esi:         esi,
+		EthernetTag: etag,
+		Label:       vni,
+	}, vtep, []*apb.Any{b.routeTarget(evi), vxlanEncap()})
+}
+
+// adPerEsPath is the A-D per ES route (type 1) of a multi-homed VTEP, used for mass withdrawal.
+// It carries the route-targets of all EVIs of the VTEP and the single-active flag of the segment
+func (b *BGPSpeaker) adPerEsPath(vtep string, esi *api.EthernetSegmentIdentifier, singleActive bool, evis []uint32) *api.Path {
+	esiLabel, _ := apb.New(&api.ESILabelExtended{
+		IsSingleActive: singleActive,
+		Label:          0,
+	})
+
+	communities := []*apb.Any{esiLabel, vxlanEncap()}
+	for _, evi := range evis {
+		communities = append(communities, b.routeTarget(evi))
+	}
+
+	return newEvpnPath(&api.EVPNEthernetAutoDiscoveryRoute{
+		Rd:          routeDistinguisher(vtep, 0),
+		Esi:         esi,
+		EthernetTag: 0xFFFFFFFF, // MAX-ET
+		Label:       0,
+	}, vtep, communities)
+}
+
+// ethernetSegmentPath is the ES route (type 4) of a multi-homed VTEP, imported by the other PEs of the segment
+func (b *BGPSpeaker) ethernetSegmentPath(vtep string, esi *api.EthernetSegmentIdentifier) *api.Path {
+	// The ES-Import route-target is the high-order 6 bytes of the ESI value
+	esImport, _ := apb.New(&api.ESImportRouteTarget{
+		EsImport: net.HardwareAddr(esi.Value[:6]).String(),
+	})
+
+	return newEvpnPath(&api.EVPNEthernetSegmentRoute{
+		Rd:        routeDistinguisher(vtep, 0),
+		Esi:       esi,
+		IpAddress: vtep,
+	}, vtep, []*apb.Any{esImport})
+}
+
+// ipPrefixPath is the IP Prefix route (type 5) of a subnet behind a VTEP in an ip-vrf, with the L3 VNI as label
+func (b *BGPSpeaker) ipPrefixPath(vtep string, originator string, vni uint32, evi uint32, routerMac string, prefix string) *api.Path {
+	ip, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		b.logger.Error().Err(err).Str("vtep", vtep).Str("prefix", prefix).Msg("Invalid IP prefix")
+		return nil
+	}
+	ones, _ := ipNet.Mask.Size()
+	gateway := "0.0.0.0"
+	if ip.To4() == nil {
+		gateway = "::"
+	}
+
+	communities := []*apb.Any{b.routeTarget(evi), vxlanEncap()}
+	if routerMac != "" {
+		rmac, _ := apb.New(&api.RouterMacExtended{
+			Mac: routerMac,
+		})
+		communities = append(communities, rmac)
+	}
+
+	return newEvpnPath(&api.EVPNIPPrefixRoute{
+		Rd:          routeDistinguisher(originator, evi),
+		Esi:         &api.EthernetSegmentIdentifier{},
+		EthernetTag: uint32(0),
+		IpPrefix:    ipNet.IP.String(),
+		IpPrefixLen: uint32(ones),
+		GwAddress:   gateway,
+		Label:       vni,
+	}, vtep, communities)
+}
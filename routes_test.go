@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	"github.com/osrg/gobgp/v3/pkg/packet/bgp"
+	"github.com/rs/zerolog"
+)
+
+func newTestSpeaker() *BGPSpeaker {
+	logger := zerolog.Nop()
+	b := NewBGPSpeaker(&logger)
+	b.out = ioutil.Discard
+	b.LocalAS, b.PeerAS = 65000, 65000
+	b.RouterId, b.Neighbour = "127.0.0.1", "127.0.0.2"
+	return b
+}
+
+// allPaths builds the originated paths of all given VRFs
+func allPaths(b *BGPSpeaker, configs map[string]VniConfig) map[string]map[string]*originatedPath {
+	b.vniConfigs = configs
+	vrfs := make(map[string]bool)
+	for vrf := range configs {
+		vrfs[vrf] = true
+	}
+	return b.originatedPaths(vrfs)
+}
+
+// testPaths renders originated paths as "<vrf> <nlri>" with their extended communities
+func testPaths(t *testing.T, paths map[string]map[string]*originatedPath) map[string]string {
+	rendered := make(map[string]string)
+	for vrf, vrfPaths := range paths {
+		for key, p := range vrfPaths {
+			if p.vrf != vrf {
+				t.Errorf("path %s of %s recorded in %s", key, p.vrf, vrf)
+			}
+			attrs, err := apiutil.UnmarshalPathAttributes(p.path.Pattrs)
+			if err != nil {
+				t.Fatalf("path %s: %v", key, err)
+			}
+			var communities string
+			for _, attr := range attrs {
+				if ext, ok := attr.(*bgp.PathAttributeExtendedCommunities); ok {
+					communities = fmt.Sprint(ext)
+				}
+			}
+			rendered[p.vrf+" "+key] = communities
+		}
+	}
+	return rendered
+}
+
+func TestParseEsi(t *testing.T) {
+	esi, err := parseEsi("01:11:22:33:44:55:66:00:01:00")
+	if err != nil {
+		t.Fatalf("parseEsi() error = %v", err)
+	}
+	if esi.Type != 1 || !reflect.DeepEqual(esi.Value, []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0, 1, 0}) {
+		t.Errorf("parseEsi() = %v", esi)
+	}
+	for _, invalid := range []string{"", "01:11:22:33:44:55:66:00:01", "01:11:22:33:44:55:66:00:01:00:00", "zz:11:22:33:44:55:66:00:01:00"} {
+		if _, err := parseEsi(invalid); err == nil {
+			t.Errorf("parseEsi(%q) accepted an invalid ESI", invalid)
+		}
+	}
+}
+
+func TestOriginatedPathsEthernetSegment(t *testing.T) {
+	b := newTestSpeaker()
+	b.ethernetSegments = map[string]EthernetSegment{
+		// 10.0.0.9 isn't in any mac-vrf, it doesn't join the segment
+		"es-1": {Esi: "01:11:22:33:44:55:66:00:01:00", MultiHomingMode: "MULTI_HOMING_MODE_single_active", Vteps: []string{"10.0.0.1", "10.0.0.9"}},
+		"bad":  {Esi: "01:02", Vteps: []string{"10.0.0.3"}},
+	}
+	paths := allPaths(b, map[string]VniConfig{
+		"mac-vrf-1": {Evi: "20", Vni: "200", Vteps: map[string]Vtep{
+			"10.0.0.1": {Address: "10.0.0.1", StaticMacs: []string{"00:00:00:00:00:01"}},
+			"10.0.0.3": {Address: "10.0.0.3"},
+		}},
+		"mac-vrf-2": {Evi: "10", Vni: "100", Vteps: map[string]Vtep{
+			"10.0.0.1": {Address: "10.0.0.1"},
+		}},
+	})
+
+	esi := "[esi:ESI_LACP | system mac 11:22:33:44:55:66, port key 1]"
+	want := map[string]string{
+		"mac-vrf-1 [type:multicast][rd:10.0.0.1:20][etag:0][ip:10.0.0.1]":                  "{Extcomms: [65000:20], [VXLAN]}",
+		"mac-vrf-1 [type:macadv][rd:10.0.0.1:20][etag:0][mac:00:00:00:00:00:01][ip:<nil>]": "{Extcomms: [65000:20], [VXLAN], [mac-mobility: 0]}",
+		"mac-vrf-1 [type:A-D][rd:10.0.0.1:20]" + esi + "[etag:0]":                          "{Extcomms: [65000:20], [VXLAN]}",
+		"mac-vrf-1 [type:multicast][rd:10.0.0.3:20][etag:0][ip:10.0.0.3]":                  "{Extcomms: [65000:20], [VXLAN]}",
+		"mac-vrf-2 [type:multicast][rd:10.0.0.1:10][etag:0][ip:10.0.0.1]":                  "{Extcomms: [65000:10], [VXLAN]}",
+		"mac-vrf-2 [type:A-D][rd:10.0.0.1:10]" + esi + "[etag:0]":                          "{Extcomms: [65000:10], [VXLAN]}",
+		"default [type:A-D][rd:10.0.0.1:0]" + esi + "[etag:4294967295]":                    "{Extcomms: [esi-label: 0, single-active], [VXLAN], [65000:10], [65000:20]}",
+		"default [type:esi][rd:10.0.0.1:0]" + esi + "[ip:10.0.0.1]":                        "{Extcomms: [es-import rt: 11:22:33:44:55:66]}",
+	}
+	got := testPaths(t, paths)
+	if !reflect.DeepEqual(got, want) {
+		var keys []string
+		for key, communities := range got {
+			keys = append(keys, key+" "+communities)
+		}
+		sort.Strings(keys)
+		t.Errorf("originatedPaths() =\n%s", strings.Join(keys, "\n"))
+	}
+}
+
+func TestOriginatedPathsIpPrefix(t *testing.T) {
+	b := newTestSpeaker()
+	// Only VTEPs of mac-vrfs join an ethernet segment
+	b.ethernetSegments = map[string]EthernetSegment{
+		"es-1": {Esi: "01:11:22:33:44:55:66:00:01:00", Vteps: []string{"10.0.0.1"}},
+	}
+	paths := allPaths(b, map[string]VniConfig{
+		"ip-vrf-1": {Type: "ip-vrf", Evi: "30", Vni: "300", Vteps: map[string]Vtep{
+			"10.0.0.1": {
+				Address:    "10.0.0.1",
+				RouterMac:  "00:00:5e:00:53:01",
+				IpPrefixes: []string{"192.168.1.7/24", "2001:db8::/32", "bogus"},
+				// Not advertised in an ip-vrf
+				StaticMacs: []string{"00:00:00:00:00:01"},
+			},
+			"10.0.0.2": {Address: "10.0.0.2", IpPrefixes: []string{"192.168.2.0/24"}},
+		}},
+	})
+
+	want := map[string]string{
+		"ip-vrf-1 [type:Prefix][rd:10.0.0.1:30][etag:0][prefix:192.168.1.0/24]": "{Extcomms: [65000:30], [VXLAN], [router's mac: 00:00:5e:00:53:01]}",
+		"ip-vrf-1 [type:Prefix][rd:10.0.0.1:30][etag:0][prefix:2001:db8::/32]":  "{Extcomms: [65000:30], [VXLAN], [router's mac: 00:00:5e:00:53:01]}",
+		"ip-vrf-1 [type:Prefix][rd:10.0.0.2:30][etag:0][prefix:192.168.2.0/24]": "{Extcomms: [65000:30], [VXLAN]}",
+	}
+	got := testPaths(t, paths)
+	if !reflect.DeepEqual(got, want) {
+		var keys []string
+		for key, communities := range got {
+			keys = append(keys, key+" "+communities)
+		}
+		sort.Strings(keys)
+		t.Errorf("originatedPaths() =\n%s", strings.Join(keys, "\n"))
+	}
+	for _, p := range paths["ip-vrf-1"] {
+		prefix, err := apiutil.UnmarshalNLRI(bgp.RF_EVPN, p.path.Nlri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := prefix.(*bgp.EVPNNLRI).RouteTypeData.(*bgp.EVPNIPPrefixRoute)
+		if route.Label != 300 {
+			t.Errorf("%s label = %d, want the L3 VNI 300", prefix, route.Label)
+		}
+	}
+}
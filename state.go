@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+)
+
+// Default location of the state file, STATIC_VXLAN_AGENT_STATE_FILE overrides it and an empty value disables persistence
+const defaultStateFile = "/etc/opt/srlinux/appmgr/static-vxlan-agent/state.json"
+
+// The messages applied with the VRF configs, in the order the BGP Speaker needs them. Together they determine the
+// originated routes
+var appliedKeys = []string{"es", "export_policy", "import_policy", "max_prefix"}
+
+// AppliedState is the configuration last applied to the BGP Speaker, saved after each commit that changes it so that a
+// restarted agent can start the speaker with the same routes before NDK has replayed the configuration
+type AppliedState struct {
+	Generation      uint64 `json:"generation"`
+	NetworkInstance string `json:"network_instance"`
+	Bgpc            string `json:"bgpc"`
+	// Data of the messages sent to the speaker, by key
+	Messages map[string]json.RawMessage `json:"messages"`
+	// Config of each VRF sent to the speaker, all of them rather than the last delta
+	Vrfs map[string]json.RawMessage `json:"vrfs"`
+}
+
+func stateFile() string {
+	if file, found := os.LookupEnv("STATIC_VXLAN_AGENT_STATE_FILE"); found {
+		return file
+	}
+	return defaultStateFile
+}
+
+// appliedState returns the state to save, with the messages and VRF configs the BGP Speaker has
+func (c *ConfigurationManager) appliedState() *AppliedState {
+	state := c.applied
+	state.Messages = make(map[string]json.RawMessage)
+	for _, key := range appliedKeys {
+		if data, found := c.sentMessages[key]; found {
+			state.Messages[key] = json.RawMessage(data)
+		}
+	}
+	state.Vrfs = c.sentVrfs
+	return &state
+}
+
+// appliedContent is what a saved state restores, i.e. the applied state without its generation
+func appliedContent(state *AppliedState) []byte {
+	content := *state
+	content.Generation = 0
+	str, _ := json.Marshal(&content)
+	return str
+}
+
+// commitApplied saves the applied state after a commit.end, if the commit changed what the BGP Speaker got.
+// Reachability and discovery events between commits change the routes too, but the next commit.end or warm start
+// applies them again anyway
+func (c *ConfigurationManager) commitApplied() {
+	if c.warmStarted {
+		c.warmStarted = false
+		c.logger.Info().Uint64("generation", c.applied.Generation).Msg("Reconciled warm-started BGP Speaker with the configuration")
+	}
+	state := c.appliedState()
+	content := appliedContent(state)
+	if bytes.Equal(content, c.savedContent) {
+		return
+	}
+	c.applied.Generation++
+	state.Generation = c.applied.Generation
+	if c.saveState(state) {
+		c.savedContent = content
+	}
+}
+
+// saveState writes the applied state to a temporary file first, so a crash never leaves a partial state file.
+// It returns whether the state is saved, or persistence is disabled
+func (c *ConfigurationManager) saveState(state *AppliedState) bool {
+	file := stateFile()
+	if file == "" {
+		return true
+	}
+	str, err := json.Marshal(state)
+	if err != nil {
+		c.logger.Warn().Err(err).Msg("Can't encode applied state")
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		c.logger.Warn().Err(err).Str("file", file).Msg("Can't save applied state")
+		return false
+	}
+	if err := ioutil.WriteFile(file+".tmp", str, 0644); err != nil {
+		c.logger.Warn().Err(err).Str("file", file).Msg("Can't save applied state")
+		return false
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		c.logger.Warn().Err(err).Str("file", file).Msg("Can't save applied state")
+		return false
+	}
+	c.logger.Debug().Uint64("generation", state.Generation).Str("file", file).Msg("Saved applied state")
+	return true
+}
+
+// warmStart starts the BGP Speaker with the last applied state, if any. The first commit.end of the NDK replay
+// then reconciles it with the actual configuration, the speaker only programs what changed
+func (c *ConfigurationManager) warmStart(agent *Agent) {
+	file := stateFile()
+	if file == "" {
+		return
+	}
+	str, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		c.logger.Warn().Err(err).Str("file", file).Msg("Can't read applied state, starting cold")
+		return
+	}
+	var state AppliedState
+	if err := json.Unmarshal(str, &state); err != nil || state.Bgpc == "" {
+		c.logger.Warn().Err(err).Str("file", file).Msg("Invalid applied state, starting cold")
+		return
+	}
+
+	c.logger.Info().Uint64("generation", state.Generation).Str("file", file).Msg("Warm-starting BGP Speaker from applied state")
+	c.processBgpConfig(agent, ndk.SdkMgrOperation_Create, state.NetworkInstance, state.Bgpc)
+	for _, key := range appliedKeys {
+		if data, found := state.Messages[key]; found {
+			c.sendChanged(agent, key, string(data))
+		}
+	}
+	// All VRFs as a single delta, the replay then only sends the ones that changed while the agent was down
+	if state.Vrfs != nil {
+		c.sentVrfs = state.Vrfs
+	}
+	vrfs, _ := json.Marshal(c.sentVrfs)
+	agent.SendToChildProcess("vrf", string(vrfs))
+
+	c.applied.Generation = state.Generation
+	c.savedContent = appliedContent(c.appliedState())
+	c.warmStarted = true
+	// Reachability and discovery events must not apply the partial configuration until the commit.end of the replay
+	c.inTransaction = true
+}
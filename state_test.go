@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+)
+
+func TestWarmStart(t *testing.T) {
+	vniConfig := func(evi string) string {
+		return `{"admin_state": "ADMIN_STATE_enable", "evi": {"value": "` + evi + `"}, "vni": {"value": "` + evi + `"}}`
+	}
+	commit := func(c *ConfigurationManager, agent *Agent, vrfs map[string]string) {
+		for vrf, config := range vrfs {
+			c.processNotification(agent, configNotification(ndk.SdkMgrOperation_Create, vniConfigPath, []string{vrf, "1"}, config))
+		}
+		c.processNotification(agent, commitEnd)
+	}
+	bgpc := `{"admin_state": "ADMIN_STATE_enable"}`
+	// Not started, as if the speaker of the warm start were running already
+	running := func(c *ConfigurationManager, agent *Agent) {
+		json.Unmarshal([]byte(bgpc), &c.bgpConfig)
+		c.netInst = "default"
+		agent.ChildProcess = &exec.Cmd{}
+	}
+
+	c, agent, _ := newTestConfigurationManager(t)
+	file := filepath.Join(t.TempDir(), "state.json")
+	t.Setenv("STATIC_VXLAN_AGENT_STATE_FILE", file)
+	c.applied.NetworkInstance, c.applied.Bgpc = "default", bgpc
+	commit(c, agent, map[string]string{"mac-vrf-1": vniConfig("1"), "mac-vrf-2": vniConfig("2")})
+	// Another commit without changes isn't saved
+	commit(c, agent, nil)
+
+	str, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state AppliedState
+	if err := json.Unmarshal(str, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Generation != 1 || state.NetworkInstance != "default" || len(state.Vrfs) != 2 {
+		t.Fatalf("saved state = %s", str)
+	}
+
+	// The restarted agent sends all VRFs of the state before the replay
+	restarted, agent, stdin := newTestConfigurationManager(t)
+	t.Setenv("STATIC_VXLAN_AGENT_STATE_FILE", file)
+	running(restarted, agent)
+	restarted.warmStart(agent)
+	if got := lastVrfMessage(t, stdin); got["mac-vrf-1"] == nil || got["mac-vrf-2"] == nil {
+		t.Errorf("warm start sent %v, want both mac-vrfs", got)
+	}
+	stdin.Reset()
+
+	// An event before the commit.end of the replay doesn't apply the partial configuration
+	restarted.processStateChange(agent)
+	if messages := stdin.messages(t, "vrf"); len(messages) != 0 {
+		t.Errorf("state change during the replay sent %s", messages)
+	}
+
+	// The replay only sends what changed while the agent was down
+	commit(restarted, agent, map[string]string{"mac-vrf-1": vniConfig("1"), "mac-vrf-3": vniConfig("3")})
+	got := lastVrfMessage(t, stdin)
+	if _, deleted := got["mac-vrf-2"]; len(got) != 2 || !deleted || got["mac-vrf-2"] != nil || got["mac-vrf-3"] == nil {
+		t.Errorf("replay sent %v, want mac-vrf-2 deleted and mac-vrf-3 added", got)
+	}
+	if restarted.applied.Generation != 2 {
+		t.Errorf("generation after the replay = %d, want 2", restarted.applied.Generation)
+	}
+}
+
+func TestWarmStartInvalidState(t *testing.T) {
+	c, agent, stdin := newTestConfigurationManager(t)
+	file := filepath.Join(t.TempDir(), "state.json")
+	t.Setenv("STATIC_VXLAN_AGENT_STATE_FILE", file)
+
+	for _, str := range []string{"", "{", `{"generation": 1}`} {
+		if err := ioutil.WriteFile(file, []byte(str), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c.warmStart(agent)
+		if stdin.Len() != 0 || c.warmStarted {
+			t.Errorf("warm start from %q sent %q", str, stdin.String())
+		}
+	}
+
+	// No state file at all
+	c.warmStart(agent)
+	if !reflect.DeepEqual(c.applied, AppliedState{}) {
+		t.Errorf("cold start applied %+v", c.applied)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+)
+
+// agentStatePath is the JS path of the state of the agent container in a network-instance
+func agentStatePath(netInst string) string {
+	return fmt.Sprintf(".network_instance{.name==\"%s\"}.protocols.static_vxlan_agent", netInst)
+}
+
+func (a *Agent) updateTelemetry(jsPath string, data interface{}) {
+	str, err := json.Marshal(data)
+	if err != nil {
+		a.logger.Error().Err(err).Str("path", jsPath).Msg("Can't encode telemetry")
+		return
+	}
+	a.updateTelemetryPaths(map[string]string{jsPath: string(str)})
+}
+
+// updateTelemetryPaths publishes the JSON state of several paths in a single call, it returns whether it succeeded
+func (a *Agent) updateTelemetryPaths(state map[string]string) bool {
+	if len(state) == 0 {
+		return true
+	}
+	a.telemetryLock.Lock()
+	for jsPath, data := range state {
+		a.telemetry[jsPath] = data
+	}
+	a.telemetryLock.Unlock()
+
+	req := &ndk.TelemetryUpdateRequest{}
+	for jsPath, data := range state {
+		req.State = append(req.State, &ndk.TelemetryInfo{
+			Key:  &ndk.TelemetryKey{JsPath: jsPath},
+			Data: &ndk.TelemetryData{JsonContent: data},
+		})
+	}
+
+	r, err := a.TelemetryServiceClient.TelemetryAddOrUpdate(a.telemetryCtx, req)
+	if err != nil || r.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+		a.logger.Error().Err(err).Int("paths", len(state)).Str("error", r.GetErrorStr()).Msg("Telemetry update failed")
+		return false
+	}
+	return true
+}
+
+func (a *Agent) deleteTelemetry(jsPath string) {
+	a.deleteTelemetryPaths([]string{jsPath})
+}
+
+// deleteTelemetryPaths removes the state of several paths in a single call, it returns whether it succeeded
+func (a *Agent) deleteTelemetryPaths(jsPaths []string) bool {
+	if len(jsPaths) == 0 {
+		return true
+	}
+	a.telemetryLock.Lock()
+	for _, jsPath := range jsPaths {
+		delete(a.telemetry, jsPath)
+	}
+	a.telemetryLock.Unlock()
+
+	req := &ndk.TelemetryDeleteRequest{}
+	for _, jsPath := range jsPaths {
+		req.Key = append(req.Key, &ndk.TelemetryKey{JsPath: jsPath})
+	}
+
+	r, err := a.TelemetryServiceClient.TelemetryDelete(a.telemetryCtx, req)
+	if err != nil || r.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+		a.logger.Error().Err(err).Int("paths", len(jsPaths)).Str("error", r.GetErrorStr()).Msg("Telemetry delete failed")
+		return false
+	}
+	return true
+}
+
+// deleteAllTelemetry removes all state published by the agent, on shutdown
+func (a *Agent) deleteAllTelemetry(ctx context.Context) {
+	a.telemetryLock.Lock()
+	defer a.telemetryLock.Unlock()
+	if len(a.telemetry) == 0 {
+		return
+	}
+
+	var keys []*ndk.TelemetryKey
+	for jsPath := range a.telemetry {
+		keys = append(keys, &ndk.TelemetryKey{JsPath: jsPath})
+	}
+	r, err := a.TelemetryServiceClient.TelemetryDelete(ctx, &ndk.TelemetryDeleteRequest{Key: keys})
+	if err != nil || r.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+		a.logger.Error().Err(err).Str("error", r.GetErrorStr()).Msg("Telemetry delete failed")
+		return
+	}
+	a.logger.Info().Int("paths", len(keys)).Msg("Deleted telemetry")
+	a.telemetry = make(map[string]string)
+}
+
+// replayTelemetry publishes all state of the agent again, after the NDK manager restarted and lost it
+func (a *Agent) replayTelemetry(ctx context.Context) {
+	a.telemetryLock.Lock()
+	defer a.telemetryLock.Unlock()
+	if len(a.telemetry) == 0 {
+		return
+	}
+
+	var state []*ndk.TelemetryInfo
+	for jsPath, data := range a.telemetry {
+		state = append(state, &ndk.TelemetryInfo{
+			Key:  &ndk.TelemetryKey{JsPath: jsPath},
+			Data: &ndk.TelemetryData{JsonContent: data},
+		})
+	}
+	r, err := a.TelemetryServiceClient.TelemetryAddOrUpdate(ctx, &ndk.TelemetryUpdateRequest{State: state})
+	if err != nil || r.GetStatus() != ndk.SdkMgrStatus_kSdkMgrSuccess {
+		a.logger.Error().Err(err).Str("error", r.GetErrorStr()).Msg("Telemetry replay failed")
+		return
+	}
+	a.logger.Info().Int("paths", len(state)).Msg("Replayed telemetry")
+}
@@ -97,6 +97,15 @@ class srl:
         )]
         self.gc.set(update=m, encoding=enc)
 
+    def set_vtep_macs(self, evi, vtep, *macs):
+        m = [(
+            f"/network-instance[name=mac-vrf{evi}]/protocols/bgp-evpn/bgp-instance[id=1]/static-vxlan-agent/static-vtep[vtep-ip={vtep}]",
+            {
+                "static-macs": list(macs)
+            }
+        )]
+        self.gc.set(update=m, encoding=enc)
+
 
     def setup_mac_vrf(self, vlan, evi, vni):
         m = [(
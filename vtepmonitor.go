@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+	"github.com/rs/zerolog"
+)
+
+const (
+	reachable   = "reachable"
+	unreachable = "unreachable"
+	unknown     = "unknown"
+)
+
+// NDK doesn't mark the end of its initial replay of the routes, it is assumed complete routeReplayDelay after
+// the first route notification. Until then, VTEPs monitored with routes are unknown rather than unreachable
+const routeReplayDelay = 5 * time.Second
+
+// VtepReachability is the liveness tracking configuration of a static VTEP
+type VtepReachability struct {
+	Monitoring       string `json:"monitoring"`
+	ProbeInterval    uint32 `json:"probe_interval"`
+	FailureThreshold uint32 `json:"failure_threshold"`
+}
+
+type icmpProbe struct {
+	config   VtepReachability
+	cancel   context.CancelFunc
+	failures uint32
+	state    string
+}
+
+// VtepMonitor tracks the reachability of static VTEPs in the default network-instance,
+// from NDK route and BFD session notifications or with ICMP probes
+type VtepMonitor struct {
+	logger *zerolog.Logger
+
+	// Signals a VTEP, as <vrf>/<address>, whose ICMP reachability changed. An empty one once routes were replayed
+	Events chan string
+
+	// Host routes of the default network-instance
+	routes map[string]bool
+	bfd    map[string]bool
+
+	mu             sync.Mutex
+	routeReplay    *time.Timer
+	routesReplayed bool
+	// ICMP probes by <vrf>/<address>, a VTEP of several mac-vrfs may be probed differently in each
+	probes map[string]*icmpProbe
+}
+
+func NewVtepMonitor(logger *zerolog.Logger) *VtepMonitor {
+	return &VtepMonitor{
+		logger: logger,
+		Events: make(chan string, 16),
+		routes: make(map[string]bool),
+		bfd:    make(map[string]bool),
+		probes: make(map[string]*icmpProbe),
+	}
+}
+
+func probeKey(vrf string, vtep string) string {
+	return vrf + "/" + vtep
+}
+
+func monitoringMode(r VtepReachability) string {
+	return strings.TrimPrefix(r.Monitoring, "MONITORING_")
+}
+
+// Reachability returns the state of a VTEP in a mac-vrf, or "" when it isn't monitored.
+// Only unreachable VTEPs get their routes withdrawn, unknown ones are still advertised
+func (m *VtepMonitor) Reachability(vrf string, vtep string, r VtepReachability) string {
+	switch monitoringMode(r) {
+	case "route":
+		// Only a host route of the VTEP itself counts, not a covering aggregate or default route
+		if m.routes[vtep] {
+			return reachable
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !m.routesReplayed {
+			return unknown
+		}
+		return unreachable
+	case "bfd":
+		up, found := m.bfd[vtep]
+		if !found {
+			return unknown
+		}
+		if up {
+			return reachable
+		}
+		return unreachable
+	case "icmp":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if p, found := m.probes[probeKey(vrf, vtep)]; found {
+			return p.state
+		}
+		return unknown
+	}
+	return ""
+}
+
+// SyncProbes starts and stops ICMP probes to match the configured VTEPs, by <vrf>/<address>
+func (m *VtepMonitor) SyncProbes(vteps map[string]VtepReachability) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, p := range m.probes {
+		if config, found := vteps[key]; !found || config != p.config {
+			p.cancel()
+			delete(m.probes, key)
+		}
+	}
+
+	for key, config := range vteps {
+		if _, found := m.probes[key]; found || monitoringMode(config) != "icmp" {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p := &icmpProbe{config: config, cancel: cancel, state: unknown}
+		m.probes[key] = p
+		go m.runProbe(ctx, key, p)
+	}
+}
+
+// StopProbe stops the ICMP probe of a VTEP in a mac-vrf, e.g. once it is deleted
+func (m *VtepMonitor) StopProbe(vrf string, vtep string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, found := m.probes[probeKey(vrf, vtep)]; found {
+		p.cancel()
+		delete(m.probes, probeKey(vrf, vtep))
+	}
+}
+
+func (m *VtepMonitor) runProbe(ctx context.Context, key string, p *icmpProbe) {
+	vtep := key[strings.LastIndex(key, "/")+1:]
+	interval := time.Duration(p.config.ProbeInterval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// The VTEPs are reachable in the default network-instance, like the BGP Speaker's peer
+		err := exec.CommandContext(ctx, "ip", "netns", "exec", "srbase-default",
+			"ping", "-c", "1", "-W", "1", vtep).Run()
+
+		m.mu.Lock()
+		state := p.state
+		if err == nil {
+			p.failures = 0
+			state = reachable
+		} else if ctx.Err() == nil {
+			p.failures++
+			if p.failures >= p.config.FailureThreshold {
+				state = unreachable
+			}
+		}
+		changed := state != p.state
+		p.state = state
+		m.mu.Unlock()
+
+		if changed {
+			m.logger.Info().Str("vtep", key).Str("reachability", state).Msg("ICMP reachability of VTEP changed")
+			select {
+			case m.Events <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ProcessRoute tracks the host routes of the default network-instance, the ones of VTEPs tell they are reachable
+func (m *VtepMonitor) ProcessRoute(n *ndk.IpRouteNotification) bool {
+	m.startRouteReplay()
+	if n.GetKey().GetNetInstName() != "default" {
+		return false
+	}
+	prefix := n.GetKey().GetIpPrefix()
+	ip := net.IP(prefix.GetIpAddr().GetAddr())
+	if ip.To4() == nil || prefix.GetPrefixLength() != 32 {
+		return false
+	}
+
+	if n.GetOp() == ndk.SdkMgrOperation_Delete {
+		delete(m.routes, ip.String())
+	} else {
+		m.routes[ip.String()] = true
+	}
+	return true
+}
+
+// startRouteReplay starts waiting for the end of the route replay, on the first route notification
+func (m *VtepMonitor) startRouteReplay() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.routeReplay != nil {
+		return
+	}
+	m.routeReplay = time.AfterFunc(routeReplayDelay, func() {
+		m.mu.Lock()
+		m.routesReplayed = true
+		m.mu.Unlock()
+		m.logger.Info().Msg("Routes replayed, VTEPs without a host route are unreachable")
+		m.Events <- ""
+	})
+}
+
+// ProcessBfd tracks BFD sessions towards VTEPs, which must be configured in SR Linux
+func (m *VtepMonitor) ProcessBfd(n *ndk.BfdSessionNotification) bool {
+	dst := net.IP(n.GetKey().GetDstIpAddr().GetAddr()).String()
+	if n.GetOp() == ndk.SdkMgrOperation_Delete {
+		delete(m.bfd, dst)
+	} else {
+		m.bfd[dst] = n.GetData().GetStatus() == ndk.BfdmgrSessionStatus_UP
+	}
+	return true
+}
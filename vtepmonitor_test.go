@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/nokia/srlinux-ndk-go/ndk"
+	"github.com/rs/zerolog"
+)
+
+func testRouteNotification(op ndk.SdkMgrOperation, netInst string, prefix string) *ndk.IpRouteNotification {
+	_, ipNet, _ := net.ParseCIDR(prefix)
+	length, _ := ipNet.Mask.Size()
+	return &ndk.IpRouteNotification{
+		Op: op,
+		Key: &ndk.RouteKeyPb{
+			NetInstName: netInst,
+			IpPrefix:    &ndk.IpAddrPrefLenPb{IpAddr: &ndk.IpAddressPb{Addr: ipNet.IP.To4()}, PrefixLength: uint32(length)},
+		},
+	}
+}
+
+func TestVtepMonitorRoutes(t *testing.T) {
+	logger := zerolog.Nop()
+	m := NewVtepMonitor(&logger)
+	route := VtepReachability{Monitoring: "MONITORING_route"}
+
+	if got := m.Reachability("mac-vrf-1", "1.1.1.1", route); got != unknown {
+		t.Errorf("Reachability() before any route = %q, want %q", got, unknown)
+	}
+
+	tests := []struct {
+		name    string
+		n       *ndk.IpRouteNotification
+		tracked bool
+	}{
+		{name: "host route", n: testRouteNotification(ndk.SdkMgrOperation_Create, "default", "1.1.1.1/32"), tracked: true},
+		{name: "aggregate route", n: testRouteNotification(ndk.SdkMgrOperation_Create, "default", "2.2.2.0/24")},
+		{name: "other network-instance", n: testRouteNotification(ndk.SdkMgrOperation_Create, "mgmt", "3.3.3.3/32")},
+	}
+	for _, tt := range tests {
+		if got := m.ProcessRoute(tt.n); got != tt.tracked {
+			t.Errorf("ProcessRoute(%s) = %v, want %v", tt.name, got, tt.tracked)
+		}
+	}
+	// Not waiting for the end of the replay
+	m.mu.Lock()
+	m.routeReplay.Stop()
+	m.routesReplayed = true
+	m.mu.Unlock()
+
+	for vtep, want := range map[string]string{
+		"1.1.1.1": reachable,
+		// Covered by the aggregate only
+		"2.2.2.2": unreachable,
+		"3.3.3.3": unreachable,
+	} {
+		if got := m.Reachability("mac-vrf-1", vtep, route); got != want {
+			t.Errorf("Reachability(%s) = %q, want %q", vtep, got, want)
+		}
+	}
+
+	m.ProcessRoute(testRouteNotification(ndk.SdkMgrOperation_Delete, "default", "1.1.1.1/32"))
+	if got := m.Reachability("mac-vrf-1", "1.1.1.1", route); got != unreachable {
+		t.Errorf("Reachability() after the route is deleted = %q, want %q", got, unreachable)
+	}
+}
+
+func TestVtepMonitorBfd(t *testing.T) {
+	logger := zerolog.Nop()
+	m := NewVtepMonitor(&logger)
+	bfd := VtepReachability{Monitoring: "MONITORING_bfd"}
+	session := func(op ndk.SdkMgrOperation, status ndk.BfdmgrSessionStatus) *ndk.BfdSessionNotification {
+		return &ndk.BfdSessionNotification{
+			Op:   op,
+			Key:  &ndk.BfdmgrGeneralSessionKeyPb{DstIpAddr: &ndk.IpAddressPb{Addr: net.ParseIP("1.1.1.1").To4()}},
+			Data: &ndk.BfdmgrGeneralSessionDataPb{Status: status},
+		}
+	}
+
+	steps := []struct {
+		n    *ndk.BfdSessionNotification
+		want string
+	}{
+		{n: nil, want: unknown},
+		{n: session(ndk.SdkMgrOperation_Create, ndk.BfdmgrSessionStatus_UP), want: reachable},
+		{n: session(ndk.SdkMgrOperation_Change, ndk.BfdmgrSessionStatus_DOWN), want: unreachable},
+		{n: session(ndk.SdkMgrOperation_Delete, ndk.BfdmgrSessionStatus_DOWN), want: unknown},
+	}
+	for i, step := range steps {
+		if step.n != nil {
+			m.ProcessBfd(step.n)
+		}
+		if got := m.Reachability("mac-vrf-1", "1.1.1.1", bfd); got != step.want {
+			t.Errorf("step %d: Reachability() = %q, want %q", i, got, step.want)
+		}
+	}
+
+	if got := m.Reachability("mac-vrf-1", "1.1.1.1", VtepReachability{}); got != "" {
+		t.Errorf("Reachability() of an unmonitored VTEP = %q, want none", got)
+	}
+}
+
+func TestVtepMonitorStopProbe(t *testing.T) {
+	logger := zerolog.Nop()
+	m := NewVtepMonitor(&logger)
+	icmp := VtepReachability{Monitoring: "MONITORING_icmp", FailureThreshold: 3}
+
+	// A probe as SyncProbes starts it, without pinging
+	ctx, cancel := context.WithCancel(context.Background())
+	m.probes[probeKey("mac-vrf-1", "1.1.1.1")] = &icmpProbe{config: icmp, cancel: cancel, state: unreachable}
+	if got := m.Reachability("mac-vrf-1", "1.1.1.1", icmp); got != unreachable {
+		t.Errorf("Reachability() = %q, want %q", got, unreachable)
+	}
+	// Probes are per mac-vrf
+	if got := m.Reachability("mac-vrf-2", "1.1.1.1", icmp); got != unknown {
+		t.Errorf("Reachability() in another mac-vrf = %q, want %q", got, unknown)
+	}
+
+	m.StopProbe("mac-vrf-1", "1.1.1.1")
+	if ctx.Err() == nil {
+		t.Errorf("StopProbe() didn't stop the probe")
+	}
+	if got := m.Reachability("mac-vrf-1", "1.1.1.1", icmp); got != unknown {
+		t.Errorf("Reachability() after StopProbe() = %q, want %q", got, unknown)
+	}
+}